@@ -0,0 +1,253 @@
+package redis
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// CLUSTER NODES中的一个节点
+type ClusterNode struct {
+	ID        string
+	Addr      string   // host:port，不含集群总线端口
+	Flags     []string // myself, master, slave, fail 等
+	Master    string   // 从节点对应的主节点ID，主节点为空
+	LinkState string
+	Slots     []string // 如 "0-5460"、"[5461->-nodeid]"
+}
+
+// 读取CLUSTER INFO
+func (p *Redis) ClusterInfo() (map[string]string, error) {
+	info, err := redis.String(p.Do(0, "CLUSTER", "INFO"))
+	if err != nil {
+		return nil, err
+	}
+	return parseInfo(info), nil
+}
+
+// 读取CLUSTER NODES并解析节点拓扑
+func (p *Redis) ClusterNodes() ([]ClusterNode, error) {
+	reply, err := redis.String(p.Do(0, "CLUSTER", "NODES"))
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes []ClusterNode
+	for _, line := range strings.Split(reply, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 8 {
+			return nil, fmt.Errorf("CLUSTER NODES 返回格式错误: %s", line)
+		}
+		node := ClusterNode{
+			ID:        fields[0],
+			Addr:      fields[1],
+			Flags:     strings.Split(fields[2], ","),
+			LinkState: fields[7],
+			Slots:     fields[8:],
+		}
+		if i := strings.IndexAny(node.Addr, "@,"); i >= 0 {
+			node.Addr = node.Addr[:i]
+		}
+		if fields[3] != "-" {
+			node.Master = fields[3]
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// 将运行时配置写回配置文件(CONFIG REWRITE)
+func (p *Redis) ConfigRewrite() error {
+	_, err := p.Do(0, "CONFIG", "REWRITE")
+	return err
+}
+
+// 当前连接认证的ACL用户
+func (p *Redis) ACLWhoAmI() (string, error) {
+	return redis.String(p.Do(0, "ACL", "WHOAMI"))
+}
+
+// ACL规则列表，每项为一个用户的规则描述
+func (p *Redis) ACLList() ([]string, error) {
+	return redis.Strings(p.Do(0, "ACL", "LIST"))
+}
+
+// key的诊断信息
+type KeyInfo struct {
+	Exists    bool
+	Type      string
+	TTL       time.Duration // 未设置过期为-1，key不存在为-2
+	SizeBytes int64         // MEMORY USAGE，key不存在为0
+}
+
+// 一次管道获取多个key的存在性、类型、剩余过期时间和内存占用
+func (p *Redis) InspectKeys(db int, keys ...string) (map[string]KeyInfo, error) {
+	result := make(map[string]KeyInfo, len(keys))
+	if len(keys) == 0 {
+		return result, nil
+	}
+	conn, err := p.getConn(db)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	for _, key := range keys {
+		conn.Send("EXISTS", key)
+		conn.Send("TYPE", key)
+		conn.Send("PTTL", key)
+		conn.Send("MEMORY", "USAGE", key)
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+
+	var firstErr error
+	setErr := func(err error) {
+		if err != nil && err != redis.ErrNil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, key := range keys {
+		var info KeyInfo
+		var err error
+		info.Exists, err = redis.Bool(conn.Receive())
+		setErr(err)
+		info.Type, err = redis.String(conn.Receive())
+		setErr(err)
+		ttl, err := redis.Int64(conn.Receive())
+		setErr(err)
+		if ttl >= 0 {
+			info.TTL = time.Duration(ttl) * time.Millisecond
+		} else {
+			info.TTL = time.Duration(ttl)
+		}
+		info.SizeBytes, err = redis.Int64(conn.Receive())
+		setErr(err)
+		result[key] = info
+	}
+	return result, firstErr
+}
+
+// 获取key的内部编码(OBJECT ENCODING)，key不存在返回redis.ErrNil
+func (p *Redis) ObjectEncoding(db int, key string) (string, error) {
+	return redis.String(p.Do(db, "OBJECT", "ENCODING", key))
+}
+
+// 获取key占用的内存字节数(MEMORY USAGE)，key不存在返回redis.ErrNil
+func (p *Redis) MemoryUsage(db int, key string) (int64, error) {
+	return redis.Int64(p.Do(db, "MEMORY", "USAGE", key))
+}
+
+// 内存压缩建议
+type CompactionHint struct {
+	Key         string
+	Type        string
+	Encoding    string
+	Length      int64 // 元素数量
+	MemoryBytes int64
+	Reason      string
+}
+
+// 大编码与对应的紧凑编码阈值配置，新版本为listpack，旧版本为ziplist
+var compactEncodings = map[string]struct {
+	encoding  string
+	lenCmd    string
+	configs   []string
+	compactTo string
+}{
+	"hash": {"hashtable", "HLEN", []string{"hash-max-listpack-entries", "hash-max-ziplist-entries"}, "listpack"},
+	"zset": {"skiplist", "ZCARD", []string{"zset-max-listpack-entries", "zset-max-ziplist-entries"}, "listpack"},
+	"set":  {"hashtable", "SCARD", []string{"set-max-listpack-entries"}, "listpack"},
+}
+
+// 扫描匹配的keys，找出元素数量已降到紧凑编码阈值以内、但仍使用大编码的hash/zset/set
+// 这类key重新写入后可转为listpack等紧凑编码以节省内存；元素值过长时重写后仍可能保持原编码
+func (p *Redis) SuggestCompaction(db int, match string) ([]CompactionHint, error) {
+	conn, err := p.getConn(db)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	config, err := redis.StringMap(conn.Do("CONFIG", "GET", "*-max-*-entries"))
+	if err != nil {
+		return nil, err
+	}
+	limits := make(map[string]int64)
+	for typ, enc := range compactEncodings {
+		for _, name := range enc.configs {
+			if v, ok := config[name]; ok {
+				limits[typ], _ = strconv.ParseInt(v, 10, 64)
+				break
+			}
+		}
+	}
+
+	var hints []CompactionHint
+	err = scanKeys(conn, match, func(keys []string) error {
+		for _, key := range keys {
+			conn.Send("TYPE", key)
+			conn.Send("OBJECT", "ENCODING", key)
+		}
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+		// 读完所有回复后再返回错误，避免连接中残留未读的回复
+		var candidates []CompactionHint
+		var firstErr error
+		for _, key := range keys {
+			typ, typErr := redis.String(conn.Receive())
+			encoding, err := redis.String(conn.Receive())
+			if err == redis.ErrNil {
+				continue
+			}
+			if typErr != nil {
+				err = typErr
+			}
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			if enc, ok := compactEncodings[typ]; ok && enc.encoding == encoding && limits[typ] > 0 {
+				candidates = append(candidates, CompactionHint{Key: key, Type: typ, Encoding: encoding})
+			}
+		}
+		if firstErr != nil || len(candidates) == 0 {
+			return firstErr
+		}
+
+		for _, c := range candidates {
+			conn.Send(compactEncodings[c.Type].lenCmd, c.Key)
+			conn.Send("MEMORY", "USAGE", c.Key)
+		}
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+		for _, c := range candidates {
+			length, err := redis.Int64(conn.Receive())
+			c.MemoryBytes, _ = redis.Int64(conn.Receive())
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			c.Length = length
+			if length > 0 && length <= limits[c.Type] {
+				c.Reason = fmt.Sprintf("%d个元素不超过%d，重写后可转为%s编码", length, limits[c.Type], compactEncodings[c.Type].compactTo)
+				hints = append(hints, c)
+			}
+		}
+		return firstErr
+	})
+	return hints, err
+}
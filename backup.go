@@ -0,0 +1,300 @@
+package redis
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Export/Import使用的JSON Lines格式，每行一个key
+// 值按类型保存：string为字符串，list/set为字符串数组，zset为exportMember数组(旧格式为ZMember数组)，hash为对象
+// Encoding为base64时所有字符串(含hash字段名和zset成员)经过base64编码，二进制值也能完整导出
+type exportRecord struct {
+	Key      string          `json:"key"`
+	Type     string          `json:"type"`
+	TTL      int64           `json:"ttl"` // 剩余毫秒，0为不过期
+	Encoding string          `json:"encoding,omitempty"`
+	Value    json.RawMessage `json:"value"`
+}
+
+// Export写出的值编码，为空表示旧格式的UTF-8文本
+const exportEncoding = "base64"
+
+// 导出的zset成员，分值保存为字符串，以支持JSON无法表示的+inf/-inf
+type exportMember struct {
+	Member string `json:"member"`
+	Score  string `json:"score"`
+}
+
+// 导出匹配的keys（string/list/set/zset/hash）及其剩余过期时间，返回导出的数量；其余类型跳过
+func (p *Redis) Export(db int, match string, w io.Writer) (int64, error) {
+	conn, err := p.getConn(db)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	enc := json.NewEncoder(w)
+	var exported int64
+	err = scanKeys(conn, match, func(keys []string) error {
+		for _, key := range keys {
+			record, ok, err := exportKey(conn, key)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			if err := enc.Encode(record); err != nil {
+				return err
+			}
+			exported++
+		}
+		return nil
+	})
+	return exported, err
+}
+
+func exportKey(conn redis.Conn, key string) (exportRecord, bool, error) {
+	record := exportRecord{Key: key, Encoding: exportEncoding}
+	typ, err := redis.String(conn.Do("TYPE", key))
+	if err != nil {
+		return record, false, err
+	}
+	record.Type = typ
+
+	var read Command
+	switch typ {
+	case "string":
+		read = Command{"GET", []interface{}{key}}
+	case "list":
+		read = Command{"LRANGE", []interface{}{key, 0, -1}}
+	case "set":
+		read = Command{"SMEMBERS", []interface{}{key}}
+	case "hash":
+		read = Command{"HGETALL", []interface{}{key}}
+	case "zset":
+		read = Command{"ZRANGE", []interface{}{key, 0, -1, "WITHSCORES"}}
+	default:
+		// none表示扫描后已被删除，其余类型不支持导出
+		return record, false, nil
+	}
+
+	// 值和剩余过期时间在同一个事务中读取，避免读取之间key过期
+	conn.Send("MULTI")
+	conn.Send(read.Name, read.Args...)
+	conn.Send("PTTL", key)
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return record, false, err
+	}
+	if len(replies) != 2 {
+		return record, false, fmt.Errorf("EXEC 返回数量错误: %d", len(replies))
+	}
+	ttl, err := redis.Int64(replies[1], nil)
+	if err != nil {
+		return record, false, err
+	}
+	if ttl == -2 {
+		return record, false, nil
+	}
+	if ttl > 0 {
+		record.TTL = ttl
+	}
+
+	var value interface{}
+	switch typ {
+	case "string":
+		var v string
+		v, err = redis.String(replies[0], nil)
+		value = encodeBase64(v)
+	case "list", "set":
+		var v []string
+		v, err = redis.Strings(replies[0], nil)
+		for i := range v {
+			v[i] = encodeBase64(v[i])
+		}
+		value = v
+	case "hash":
+		var v map[string]string
+		v, err = redis.StringMap(replies[0], nil)
+		encoded := make(map[string]string, len(v))
+		for field, fv := range v {
+			encoded[encodeBase64(field)] = encodeBase64(fv)
+		}
+		value = encoded
+	case "zset":
+		var pairs []string
+		var members []ZMember
+		if pairs, err = redis.Strings(replies[0], nil); err == nil {
+			members, err = parseZMembers(pairs)
+		}
+		encoded := make([]exportMember, len(members))
+		for i, m := range members {
+			encoded[i] = exportMember{Member: encodeBase64(m.Member), Score: scoreString(m.Score)}
+		}
+		value = encoded
+	}
+	if err == redis.ErrNil {
+		return record, false, nil
+	}
+	if err != nil {
+		return record, false, err
+	}
+	if record.Value, err = json.Marshal(value); err != nil {
+		return record, false, err
+	}
+	return record, true, nil
+}
+
+func encodeBase64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// 导入Export的数据，按类型重建key并恢复过期时间，返回导入的数量
+// 已存在的key在replace为true时覆盖，否则跳过；DryRun时不写入，只记录将被覆盖的key并返回将导入的数量
+func (p *Redis) Import(db int, r io.Reader, replace bool) (int64, error) {
+	conn, err := p.getConn(db)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	dec := json.NewDecoder(r)
+	var imported int64
+	for {
+		var record exportRecord
+		if err := dec.Decode(&record); err == io.EOF {
+			return imported, nil
+		} else if err != nil {
+			return imported, err
+		}
+
+		if !replace || p.DryRun {
+			exist, err := redis.Bool(conn.Do("EXISTS", record.Key))
+			if err != nil {
+				return imported, err
+			}
+			if exist && !replace {
+				continue
+			}
+			if p.DryRun {
+				if exist {
+					p.logf("redis dry-run: DEL db=%d key=%s", db, record.Key)
+				}
+				imported++
+				continue
+			}
+		}
+		if err := importKey(conn, record); err != nil {
+			return imported, fmt.Errorf("导入 %s 失败: %v", record.Key, err)
+		}
+		imported++
+	}
+}
+
+func importKey(conn redis.Conn, record exportRecord) error {
+	var decode func(s string) (string, error)
+	switch record.Encoding {
+	case "":
+		decode = func(s string) (string, error) { return s, nil }
+	case exportEncoding:
+		decode = func(s string) (string, error) {
+			b, err := base64.StdEncoding.DecodeString(s)
+			return string(b), err
+		}
+	default:
+		return fmt.Errorf("不支持的编码 %s", record.Encoding)
+	}
+
+	args := redis.Args{}.Add(record.Key)
+	var command string
+	switch record.Type {
+	case "string":
+		var value string
+		if err := json.Unmarshal(record.Value, &value); err != nil {
+			return err
+		}
+		value, err := decode(value)
+		if err != nil {
+			return err
+		}
+		command, args = "SET", args.Add(value)
+	case "list", "set":
+		var values []string
+		if err := json.Unmarshal(record.Value, &values); err != nil {
+			return err
+		}
+		for i := range values {
+			var err error
+			if values[i], err = decode(values[i]); err != nil {
+				return err
+			}
+		}
+		command, args = "RPUSH", args.AddFlat(values)
+		if record.Type == "set" {
+			command = "SADD"
+		}
+	case "hash":
+		var values map[string]string
+		if err := json.Unmarshal(record.Value, &values); err != nil {
+			return err
+		}
+		command = "HSET"
+		for field, value := range values {
+			field, err := decode(field)
+			if err != nil {
+				return err
+			}
+			if value, err = decode(value); err != nil {
+				return err
+			}
+			args = args.Add(field, value)
+		}
+	case "zset":
+		command = "ZADD"
+		if record.Encoding == "" {
+			var members []ZMember
+			if err := json.Unmarshal(record.Value, &members); err != nil {
+				return err
+			}
+			for _, m := range members {
+				args = args.Add(formatScore(m.Score), m.Member)
+			}
+			break
+		}
+		var members []exportMember
+		if err := json.Unmarshal(record.Value, &members); err != nil {
+			return err
+		}
+		for _, m := range members {
+			member, err := decode(m.Member)
+			if err != nil {
+				return err
+			}
+			score, err := strconv.ParseFloat(m.Score, 64)
+			if err != nil {
+				return fmt.Errorf("成员 %q 的分值错误: %v", member, err)
+			}
+			args = args.Add(scoreString(score), member)
+		}
+	default:
+		return fmt.Errorf("不支持的类型 %s", record.Type)
+	}
+
+	conn.Send("MULTI")
+	conn.Send("DEL", record.Key)
+	// 空集合无法创建，只保留DEL
+	if len(args) > 1 {
+		conn.Send(command, args...)
+		if record.TTL > 0 {
+			conn.Send("PEXPIRE", record.Key, record.TTL)
+		}
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
@@ -0,0 +1,346 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// stale-while-revalidate读取：值在freshTTL内直接返回；过期后staleTTL内先返回旧值并在后台刷新；
+// 完全过期或不存在时同步调用loader加载
+// 值以hash存储，字段v为值，f为新鲜截止时间(毫秒时间戳)
+func (p *Redis) GetSWR(db int, key string, freshTTL, staleTTL time.Duration, loader func() ([]byte, error)) ([]byte, error) {
+	values, err := redis.Values(p.Do(db, "HMGET", key, "v", "f"))
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 2 && values[0] != nil {
+		value, err := redis.Bytes(values[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		freshUntil, _ := redis.Int64(values[1], nil)
+		if nowMillis() >= freshUntil {
+			p.refreshSWR(db, key, freshTTL, staleTTL, loader)
+		}
+		return value, nil
+	}
+	return p.loadSWR(db, key, freshTTL, staleTTL, loader)
+}
+
+// 后台刷新，同一个key同时只有一个刷新任务
+func (p *Redis) refreshSWR(db int, key string, freshTTL, staleTTL time.Duration, loader func() ([]byte, error)) {
+	flightKey := fmt.Sprintf("%d:%s", db, key)
+	if _, loading := p.swrFlight.LoadOrStore(flightKey, struct{}{}); loading {
+		return
+	}
+	go func() {
+		defer p.swrFlight.Delete(flightKey)
+		p.loadSWR(db, key, freshTTL, staleTTL, loader)
+	}()
+}
+
+func (p *Redis) loadSWR(db int, key string, freshTTL, staleTTL time.Duration, loader func() ([]byte, error)) ([]byte, error) {
+	value, err := loader()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := p.getConn(db)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	freshUntil := nowMillis() + toMillis(freshTTL)
+	conn.Send("MULTI")
+	conn.Send("HSET", key, "v", value, "f", freshUntil)
+	conn.Send("PEXPIRE", key, toMillis(freshTTL+staleTTL))
+	if _, err := conn.Do("EXEC"); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// loader返回ErrNotFound表示数据源中不存在，GetOrSet会对其做空值缓存
+var ErrNotFound = errors.New("redis: 数据不存在")
+
+// 空值缓存的标记值
+const notFoundMarker = "\x00redis:not-found\x00"
+
+// 读取缓存，未命中时调用loader加载并缓存ttl（ttl<=0不过期）
+// loader返回ErrNotFound时缓存空值标记negativeTTL（<=0不缓存），期间的读取直接返回ErrNotFound，不再调用loader
+func (p *Redis) GetOrSet(db int, key string, ttl, negativeTTL time.Duration, loader func() (string, error)) (string, error) {
+	value, err := redis.String(p.Do(db, "GET", key))
+	if err == nil {
+		if value == notFoundMarker {
+			return "", ErrNotFound
+		}
+		return value, nil
+	}
+	if err != redis.ErrNil {
+		return "", err
+	}
+
+	value, err = loader()
+	if err == ErrNotFound {
+		if negativeTTL > 0 {
+			if err := p.SetWithTTL(db, key, notFoundMarker, negativeTTL); err != nil {
+				return "", err
+			}
+		}
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if ttl > 0 {
+		err = p.SetWithTTL(db, key, value, ttl)
+	} else {
+		_, err = p.Do(db, "SET", key, value)
+	}
+	if err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// CachedDo的本地结果缓存
+type resultCache struct {
+	mu      sync.Mutex
+	size    int32 // 缓存条数，Do中用于快速判断是否需要失效
+	entries map[string]cachedResult
+	byKey   map[string]map[string]struct{} // db+key -> 读取了该key的缓存项
+
+	// 正在执行的读：读取前记录key的写入代数，写入时代数加1，读完发现代数变化则不缓存，避免缓存写入前的结果
+	inflight int32             // 正在执行的读的数量，Do中用于快速判断
+	pending  map[string]int    // db+key -> 正在执行的读的数量
+	gens     map[string]uint64 // db+key -> 写入代数，只在有正在执行的读时保留
+}
+
+type cachedResult struct {
+	reply   interface{}
+	expires time.Time
+	index   string
+}
+
+// 每次写入缓存时最多检查的条目数，过期的条目被删除；其余过期条目在读取到时删除
+const resultSweep = 20
+
+// 不会修改数据的命令，通过Do执行时不触发缓存失效
+var readOnlyCommands = map[string]bool{
+	"GET": true, "MGET": true, "STRLEN": true, "GETRANGE": true, "EXISTS": true, "TYPE": true,
+	"TTL": true, "PTTL": true, "HGET": true, "HMGET": true, "HGETALL": true, "HLEN": true,
+	"HEXISTS": true, "HKEYS": true, "HVALS": true, "LLEN": true, "LRANGE": true, "LINDEX": true,
+	"SCARD": true, "SMEMBERS": true, "SISMEMBER": true, "ZCARD": true, "ZCOUNT": true,
+	"ZRANGE": true, "ZRANGEBYSCORE": true, "ZREVRANGE": true, "ZREVRANGEBYSCORE": true,
+	"ZSCORE": true, "ZMSCORE": true, "ZRANK": true, "ZREVRANK": true, "PFCOUNT": true,
+	"BITCOUNT": true, "GETBIT": true, "SCAN": true, "KEYS": true, "XRANGE": true, "XREVRANGE": true,
+	"XLEN": true, "XINFO": true, "OBJECT": true, "MEMORY": true, "INFO": true, "PING": true,
+	"SELECT": true, "WATCH": true, "UNWATCH": true, "MULTI": true, "DISCARD": true,
+}
+
+// 缓存项所属的db+key，没有参数的命令只按db归类
+func resultIndex(db int, args []interface{}) string {
+	if len(args) == 0 {
+		return fmt.Sprintf("%d\x00", db)
+	}
+	return fmt.Sprintf("%d\x00%s", db, keyString(args[0]))
+}
+
+// 执行读命令并在本地缓存结果ttl时间，命令的第一个参数视为key
+// 之后通过Do、getConn取出的连接(管道、事务、脚本等各辅助方法)对该key的写入会使缓存失效，FLUSHDB/FLUSHALL清空对应的缓存
+// 其他客户端的写入不会触发失效
+func (p *Redis) CachedDo(db int, ttl time.Duration, command string, args ...interface{}) (interface{}, error) {
+	cacheKey := fmt.Sprintf("%d\x00%s\x00%q", db, strings.ToUpper(command), args)
+	index := resultIndex(db, args)
+	now := time.Now()
+
+	c := &p.results
+	c.mu.Lock()
+	if entry, ok := c.entries[cacheKey]; ok {
+		if now.Before(entry.expires) {
+			c.mu.Unlock()
+			return entry.reply, nil
+		}
+		c.remove(cacheKey, entry)
+	}
+	if c.pending == nil {
+		c.pending = make(map[string]int)
+		c.gens = make(map[string]uint64)
+	}
+	c.pending[index]++
+	gen := c.gens[index]
+	atomic.AddInt32(&c.inflight, 1)
+	c.mu.Unlock()
+
+	// 读命令本身不触发失效，否则不在readOnlyCommands中的读命令永远不会被缓存
+	reply, err := p.doRetry(db, command, args...)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	atomic.AddInt32(&c.inflight, -1)
+	changed := c.gens[index] != gen
+	if c.pending[index]--; c.pending[index] == 0 {
+		delete(c.pending, index)
+		delete(c.gens, index)
+	}
+	if err != nil || changed {
+		return reply, err
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]cachedResult)
+		c.byKey = make(map[string]map[string]struct{})
+	}
+	c.removeExpired(now)
+	c.entries[cacheKey] = cachedResult{reply: reply, expires: now.Add(ttl), index: index}
+	if c.byKey[index] == nil {
+		c.byKey[index] = make(map[string]struct{})
+	}
+	c.byKey[index][cacheKey] = struct{}{}
+	atomic.StoreInt32(&c.size, int32(len(c.entries)))
+	return reply, nil
+}
+
+// 写命令执行后，删除读取过其参数中任一key的缓存；FLUSHDB删除该db的缓存，FLUSHALL/SWAPDB删除全部缓存
+func (p *Redis) invalidateResults(db int, command string, args []interface{}) {
+	c := &p.results
+	if command == "" || atomic.LoadInt32(&c.size) == 0 && atomic.LoadInt32(&c.inflight) == 0 {
+		return
+	}
+	command = strings.ToUpper(command)
+	if readOnlyCommands[command] {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch command {
+	case "FLUSHDB":
+		c.clear(resultIndex(db, nil))
+	case "FLUSHALL", "SWAPDB":
+		c.clear("")
+	}
+	for _, arg := range args {
+		switch arg.(type) {
+		case string, []byte:
+		default:
+			continue
+		}
+		index := resultIndex(db, []interface{}{arg})
+		for cacheKey := range c.byKey[index] {
+			delete(c.entries, cacheKey)
+		}
+		delete(c.byKey, index)
+		if c.pending[index] > 0 {
+			c.gens[index]++
+		}
+	}
+	atomic.StoreInt32(&c.size, int32(len(c.entries)))
+}
+
+// 删除index以prefix开头的所有缓存，并使正在执行的读不被缓存
+func (c *resultCache) clear(prefix string) {
+	for cacheKey, entry := range c.entries {
+		if strings.HasPrefix(entry.index, prefix) {
+			c.remove(cacheKey, entry)
+		}
+	}
+	for index := range c.pending {
+		if strings.HasPrefix(index, prefix) {
+			c.gens[index]++
+		}
+	}
+}
+
+func (c *resultCache) remove(cacheKey string, entry cachedResult) {
+	delete(c.entries, cacheKey)
+	if keys := c.byKey[entry.index]; keys != nil {
+		delete(keys, cacheKey)
+		if len(keys) == 0 {
+			delete(c.byKey, entry.index)
+		}
+	}
+	atomic.StoreInt32(&c.size, int32(len(c.entries)))
+}
+
+// 检查最多resultSweep个条目并删除其中过期的，map遍历的起点随机，多次写入后会覆盖所有条目
+func (c *resultCache) removeExpired(now time.Time) {
+	checked := 0
+	for cacheKey, entry := range c.entries {
+		if checked++; checked > resultSweep {
+			break
+		}
+		if !now.Before(entry.expires) {
+			c.remove(cacheKey, entry)
+		}
+	}
+}
+
+func keyString(arg interface{}) string {
+	if b, ok := arg.([]byte); ok {
+		return string(b)
+	}
+	return fmt.Sprint(arg)
+}
+
+// getConn返回的连接：写命令执行后使对应key的缓存失效
+// 通过Send发送的写命令在发送时和收到回复(或Close)时各失效一次，覆盖发送到执行之间开始的读
+type invalidatingConn struct {
+	redis.Conn
+	p      *Redis
+	db     int
+	queued []Command // 已发送、尚未读取回复的命令
+}
+
+func (p *Redis) invalidating(conn redis.Conn, db int) redis.Conn {
+	return &invalidatingConn{Conn: conn, p: p, db: db}
+}
+
+func (c *invalidatingConn) Do(command string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(command, args...)
+	c.p.invalidateResults(c.db, command, args)
+	c.invalidateQueued()
+	return reply, err
+}
+
+func (c *invalidatingConn) Send(command string, args ...interface{}) error {
+	c.p.invalidateResults(c.db, command, args)
+	if err := c.Conn.Send(command, args...); err != nil {
+		return err
+	}
+	c.queued = append(c.queued, Command{command, args})
+	return nil
+}
+
+func (c *invalidatingConn) Receive() (interface{}, error) {
+	reply, err := c.Conn.Receive()
+	if len(c.queued) > 0 {
+		cmd := c.queued[0]
+		c.queued = c.queued[1:]
+		c.p.invalidateResults(c.db, cmd.Name, cmd.Args)
+	}
+	return reply, err
+}
+
+func (c *invalidatingConn) Close() error {
+	err := c.Conn.Close()
+	c.invalidateQueued()
+	return err
+}
+
+func (c *invalidatingConn) invalidateQueued() {
+	for _, cmd := range c.queued {
+		c.p.invalidateResults(c.db, cmd.Name, cmd.Args)
+	}
+	c.queued = nil
+}
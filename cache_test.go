@@ -0,0 +1,109 @@
+package redis
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 记录收到的命令，按命令名返回固定回复
+type fakeConn struct {
+	calls   map[string]int
+	pending []string
+}
+
+func (c *fakeConn) Close() error { return nil }
+func (c *fakeConn) Err() error   { return nil }
+func (c *fakeConn) Flush() error { return nil }
+
+func (c *fakeConn) Do(command string, args ...interface{}) (interface{}, error) {
+	var reply interface{}
+	for _, cmd := range append(c.pending, command) {
+		if cmd != "" {
+			reply = c.reply(cmd)
+		}
+	}
+	c.pending = nil
+	return reply, nil
+}
+
+func (c *fakeConn) Send(command string, args ...interface{}) error {
+	c.pending = append(c.pending, command)
+	return nil
+}
+
+func (c *fakeConn) Receive() (interface{}, error) {
+	cmd := c.pending[0]
+	c.pending = c.pending[1:]
+	return c.reply(cmd), nil
+}
+
+func (c *fakeConn) reply(command string) interface{} {
+	command = strings.ToUpper(command)
+	c.calls[command]++
+	switch command {
+	case "SINTER":
+		return []interface{}{[]byte("x")}
+	case "EXEC":
+		return []interface{}{"OK"}
+	case "SADD":
+		return int64(1)
+	}
+	return "OK"
+}
+
+func newFakeRedis() (*Redis, *fakeConn) {
+	conn := &fakeConn{calls: make(map[string]int)}
+	p := &Redis{pool: &redis.Pool{Dial: func() (redis.Conn, error) { return conn, nil }}}
+	return p, conn
+}
+
+func TestCachedDoInvalidation(t *testing.T) {
+	p, conn := newFakeRedis()
+	read := func() {
+		t.Helper()
+		if _, err := p.CachedDo(0, time.Minute, "SINTER", "a", "b"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	steps := []struct {
+		name  string
+		write func() error
+		reads int // 执行write后再读一次，服务端累计收到的SINTER数
+	}{
+		{"cached", func() error { return nil }, 1},
+		{"other key", func() error { _, err := p.Do(0, "SADD", "c", "x"); return err }, 1},
+		{"other db", func() error { _, err := p.Do(1, "SADD", "a", "x"); return err }, 1},
+		{"Do", func() error { _, err := p.Do(0, "SADD", "a", "x"); return err }, 2},
+		{"Tx", func() error {
+			_, err := p.TxTyped(0, func(tx *Tx) { tx.QueueSet("a", "x") })
+			return err
+		}, 3},
+		{"Pipeline", func() error {
+			pl, err := p.Pipeline(0)
+			if err != nil {
+				return err
+			}
+			defer pl.Close()
+			if err := pl.Send("SADD", "a", "y"); err != nil {
+				return err
+			}
+			_, err = pl.Exec()
+			return err
+		}, 4},
+		{"FLUSHDB", func() error { _, err := p.Do(0, "FLUSHDB"); return err }, 5},
+	}
+	read()
+	for _, step := range steps {
+		if err := step.write(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		read()
+		if got := conn.calls["SINTER"]; got != step.reads {
+			t.Errorf("%s: SINTER sent %d times, want %d", step.name, got, step.reads)
+		}
+	}
+}
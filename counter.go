@@ -0,0 +1,86 @@
+package redis
+
+import (
+	"fmt"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 在Redis中累计计数，定期通过Flush写入持久存储
+// 所有计数器保存在同一个hash中，字段名为计数器名
+type DurableCounter struct {
+	p   *Redis
+	db  int
+	key string
+	// Flush时是否清零：为true时原子地取出并删除当前值，只持久化两次Flush之间的增量
+	Reset bool
+}
+
+// 创建以key为hash保存的计数器组
+func (p *Redis) NewDurableCounter(db int, key string) *DurableCounter {
+	return &DurableCounter{p: p, db: db, key: key}
+}
+
+// 计数器增加delta，返回新值
+func (c *DurableCounter) Incr(name string, delta int64) (int64, error) {
+	return redis.Int64(c.p.Do(c.db, "HINCRBY", c.key, name, delta))
+}
+
+// 原子地取出并删除所有计数，Flush期间新的增量写入新的hash，不会丢失
+var counterTakeScript = redis.NewScript(1, `
+local values = redis.call('HGETALL', KEYS[1])
+redis.call('DEL', KEYS[1])
+return values
+`)
+
+// 将当前计数逐个交给persist写入持久存储
+// Reset为true时，persist失败的和尚未持久化的计数会加回Redis，下次Flush重试
+func (c *DurableCounter) Flush(persist func(name string, value int64) error) error {
+	var reply interface{}
+	var err error
+	if c.Reset {
+		reply, err = c.p.doScript(c.db, counterTakeScript, c.key)
+	} else {
+		reply, err = c.p.Do(c.db, "HGETALL", c.key)
+	}
+	values, err := redis.Int64Map(reply, err)
+	if err != nil {
+		return err
+	}
+
+	var pending map[string]int64
+	var persistErr error
+	for name, value := range values {
+		if persistErr == nil {
+			if persistErr = persist(name, value); persistErr == nil {
+				continue
+			}
+			persistErr = fmt.Errorf("持久化计数 %s 失败: %v", name, persistErr)
+			pending = make(map[string]int64)
+		}
+		pending[name] = value
+	}
+	if persistErr == nil || !c.Reset {
+		return persistErr
+	}
+	if err := c.restore(pending); err != nil {
+		return fmt.Errorf("%v，恢复计数失败: %v", persistErr, err)
+	}
+	return persistErr
+}
+
+// 将未持久化的计数加回hash
+func (c *DurableCounter) restore(values map[string]int64) error {
+	conn, err := c.p.getConn(c.db)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	for name, value := range values {
+		conn.Send("HINCRBY", c.key, name, value)
+	}
+	_, err = conn.Do("EXEC")
+	return err
+}
@@ -0,0 +1,142 @@
+package redis
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 经纬度
+type GeoCoord struct {
+	Longitude float64
+	Latitude  float64
+}
+
+// GEOSEARCH的条件
+type GeoSearchOptions struct {
+	// 中心点：FromMember不为空时以该成员为中心，否则使用FromCoord
+	FromMember string
+	FromCoord  GeoCoord
+
+	// 范围：Width和Height大于0时按矩形(BYBOX)搜索，否则按半径(BYRADIUS)搜索
+	Radius        float64
+	Width, Height float64
+	Unit          string // m, km, ft, mi，为空时为m
+
+	Count int    // 最多返回的数量，<=0不限制
+	Any   bool   // 配合Count，找到足够的结果即返回，不保证是最近的
+	Sort  string // ASC或DESC，为空时不排序
+
+	WithCoord bool
+	WithDist  bool
+	WithHash  bool
+}
+
+// GEOSEARCH的一个结果，未请求的字段为零值
+type GeoResult struct {
+	Member   string
+	Distance float64 // 与中心点的距离，单位同GeoSearchOptions.Unit
+	GeoHash  int64
+	Coord    GeoCoord
+}
+
+// GEOSEARCH(Redis 6.2+)，按选项返回成员及其坐标、距离和geohash
+func (p *Redis) GeoSearchFull(db int, key string, opts GeoSearchOptions) ([]GeoResult, error) {
+	unit := opts.Unit
+	if unit == "" {
+		unit = "m"
+	}
+
+	args := redis.Args{}.Add(key)
+	if opts.FromMember != "" {
+		args = args.Add("FROMMEMBER", opts.FromMember)
+	} else {
+		args = args.Add("FROMLONLAT", opts.FromCoord.Longitude, opts.FromCoord.Latitude)
+	}
+	if opts.Width > 0 && opts.Height > 0 {
+		args = args.Add("BYBOX", opts.Width, opts.Height, unit)
+	} else if opts.Radius > 0 {
+		args = args.Add("BYRADIUS", opts.Radius, unit)
+	} else {
+		return nil, fmt.Errorf("需要指定 Radius 或 Width/Height")
+	}
+	switch strings.ToUpper(opts.Sort) {
+	case "":
+	case "ASC", "DESC":
+		args = args.Add(strings.ToUpper(opts.Sort))
+	default:
+		return nil, fmt.Errorf("Sort 只能为 ASC 或 DESC: %s", opts.Sort)
+	}
+	if opts.Count > 0 {
+		args = args.Add("COUNT", opts.Count)
+		if opts.Any {
+			args = args.Add("ANY")
+		}
+	}
+	if opts.WithCoord {
+		args = args.Add("WITHCOORD")
+	}
+	if opts.WithDist {
+		args = args.Add("WITHDIST")
+	}
+	if opts.WithHash {
+		args = args.Add("WITHHASH")
+	}
+
+	items, err := redis.Values(p.Do(db, "GEOSEARCH", args...))
+	if err != nil {
+		return nil, err
+	}
+	results := make([]GeoResult, 0, len(items))
+	for _, item := range items {
+		result, err := parseGeoResult(item, opts)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// 没有WITH*选项时每项为成员名，否则为数组：成员名、距离、geohash、[经度, 纬度]，只包含请求的字段
+func parseGeoResult(item interface{}, opts GeoSearchOptions) (GeoResult, error) {
+	var result GeoResult
+	if !opts.WithCoord && !opts.WithDist && !opts.WithHash {
+		member, err := redis.String(item, nil)
+		result.Member = member
+		return result, err
+	}
+
+	fields, err := redis.Values(item, nil)
+	if err != nil {
+		return result, err
+	}
+	if fields, err = redis.Scan(fields, &result.Member); err != nil {
+		return result, err
+	}
+	if opts.WithDist {
+		if fields, err = redis.Scan(fields, &result.Distance); err != nil {
+			return result, err
+		}
+	}
+	if opts.WithHash {
+		if fields, err = redis.Scan(fields, &result.GeoHash); err != nil {
+			return result, err
+		}
+	}
+	if opts.WithCoord {
+		if len(fields) == 0 {
+			return result, fmt.Errorf("GEOSEARCH 返回格式错误: 缺少坐标")
+		}
+		coord, err := redis.Float64s(fields[0], nil)
+		if err != nil {
+			return result, err
+		}
+		if len(coord) != 2 {
+			return result, fmt.Errorf("GEOSEARCH 返回格式错误: %v", coord)
+		}
+		result.Coord = GeoCoord{Longitude: coord[0], Latitude: coord[1]}
+	}
+	return result, nil
+}
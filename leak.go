@@ -0,0 +1,99 @@
+package redis
+
+import (
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 连接泄漏检测：记录每个借出连接的调用栈，超过阈值未归还时通过Logger输出
+type leakDetector struct {
+	mu        sync.Mutex
+	threshold time.Duration
+	nextID    uint64
+	borrowed  map[uint64]*borrowRecord
+	stop      chan struct{}
+}
+
+type borrowRecord struct {
+	at       time.Time
+	stack    []byte
+	reported bool
+}
+
+// 开启连接泄漏检测，借出超过threshold未Close的连接会连同借出时的调用栈输出到Logger
+// 需要在使用前调用；订阅使用的长连接不参与检测
+func (p *Redis) EnableLeakDetection(threshold time.Duration) {
+	if p.leaks != nil {
+		return
+	}
+	d := &leakDetector{
+		threshold: threshold,
+		borrowed:  make(map[uint64]*borrowRecord),
+		stop:      make(chan struct{}),
+	}
+	p.leaks = d
+
+	interval := threshold / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.report(p.logf)
+			case <-d.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (d *leakDetector) track(conn redis.Conn) redis.Conn {
+	d.mu.Lock()
+	d.nextID++
+	id := d.nextID
+	d.borrowed[id] = &borrowRecord{at: time.Now(), stack: debug.Stack()}
+	d.mu.Unlock()
+
+	return &trackedConn{Conn: conn, release: func() {
+		d.mu.Lock()
+		delete(d.borrowed, id)
+		d.mu.Unlock()
+	}}
+}
+
+// 输出超时未归还的连接，每个连接只输出一次
+func (d *leakDetector) report(logf func(format string, args ...interface{})) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	for _, r := range d.borrowed {
+		if r.reported || now.Sub(r.at) < d.threshold {
+			continue
+		}
+		r.reported = true
+		logf("redis: 连接已借出%v未归还，借出位置:\n%s", now.Sub(r.at), r.stack)
+	}
+}
+
+func (d *leakDetector) close() {
+	close(d.stop)
+}
+
+// Close时从泄漏检测中移除的连接
+type trackedConn struct {
+	redis.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
@@ -0,0 +1,98 @@
+package redis
+
+import (
+	"fmt"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Pipeline默认每多少条命令发送一次并读取回复
+const defaultPipelineFlush = 1000
+
+// 分批发送的管道：每AutoFlushEvery条命令发送一次并读取回复，避免超大管道让Redis缓存全部回复
+// 结果按发送顺序保存，Exec时一起返回；不是并发安全的
+type Pipeline struct {
+	conn    redis.Conn
+	every   int
+	names   []string
+	pending int
+	results []interface{}
+	err     error // 连接出错后不再发送
+}
+
+// 在db上创建管道，使用完需调用Close归还连接
+func (p *Redis) Pipeline(db int) (*Pipeline, error) {
+	conn, err := p.getConn(db)
+	if err != nil {
+		return nil, err
+	}
+	return &Pipeline{conn: conn, every: defaultPipelineFlush}, nil
+}
+
+// 设置每多少条命令发送一次，n<=0时只在Exec时发送
+func (pl *Pipeline) AutoFlushEvery(n int) *Pipeline {
+	pl.every = n
+	return pl
+}
+
+// 加入一条命令，达到AutoFlushEvery的数量时发送并读取这一批的回复
+func (pl *Pipeline) Send(command string, args ...interface{}) error {
+	if pl.err != nil {
+		return pl.err
+	}
+	if pl.err = pl.conn.Send(command, args...); pl.err != nil {
+		return pl.err
+	}
+	pl.names = append(pl.names, command)
+	pl.pending++
+	if pl.every > 0 && pl.pending >= pl.every {
+		return pl.flush()
+	}
+	return nil
+}
+
+// 发送未发送的命令并读取全部回复
+func (pl *Pipeline) flush() error {
+	if pl.pending == 0 {
+		return nil
+	}
+	if pl.err = pl.conn.Flush(); pl.err != nil {
+		return pl.err
+	}
+	for ; pl.pending > 0; pl.pending-- {
+		reply, err := pl.conn.Receive()
+		if _, ok := err.(redis.Error); ok {
+			reply, err = err, nil
+		}
+		if err != nil {
+			pl.err = err
+			return err
+		}
+		pl.results = append(pl.results, reply)
+	}
+	return nil
+}
+
+// 发送剩余命令，按发送顺序返回所有回复，之后管道可继续使用
+// 某条命令执行失败时，对应结果为redis.Error，其余结果照常返回，并返回第一个失败的错误
+func (pl *Pipeline) Exec() ([]interface{}, error) {
+	if err := pl.flush(); err != nil {
+		return nil, err
+	}
+	results, names := pl.results, pl.names
+	pl.results, pl.names = nil, nil
+
+	var firstErr error
+	for i, reply := range results {
+		if e, ok := reply.(redis.Error); ok {
+			firstErr = fmt.Errorf("第%d条命令 %s 执行失败: %v", i+1, names[i], e)
+			break
+		}
+	}
+	return results, firstErr
+}
+
+// 归还连接，未Exec的命令被丢弃
+func (pl *Pipeline) Close() error {
+	return pl.conn.Close()
+}
@@ -0,0 +1,529 @@
+package redis
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 订阅消息的处理函数
+type MessageHandler func(channel string, payload []byte)
+
+// 订阅频道，阻塞直到ctx取消或连接出错；ctx取消时返回nil
+func (p *Redis) Subscribe(ctx context.Context, db int, channels []string, handler MessageHandler) error {
+	if len(channels) == 0 {
+		return fmt.Errorf("channels 不允许为空")
+	}
+	_, err := p.subscribeSession(ctx, db, channels, nil, handler)
+	return err
+}
+
+// 输出订阅/退订事件及当前订阅数
+func (p *Redis) logSubscription(db int, s redis.Subscription) {
+	p.logf("redis subscribe: db=%d %s %s active=%d", db, s.Kind, s.Channel, s.Count)
+}
+
+// ctx取消时退订所有频道和模式，使Receive循环正常结束
+// 返回的stop需在关闭连接前调用，它会等待后台goroutine退出，避免与Close并发写连接
+func unsubscribeOnDone(ctx context.Context, psc redis.PubSubConn) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-ctx.Done():
+			psc.Unsubscribe()
+			psc.PUnsubscribe()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// 订阅重连的退避时间范围
+const (
+	resubscribeMinBackoff = 100 * time.Millisecond
+	resubscribeMaxBackoff = 5 * time.Second
+)
+
+// 订阅频道和模式，连接断开后自动重连，并在新连接上重新切换到db、重新订阅相同的频道和模式
+// 阻塞直到ctx取消，返回nil
+func (p *Redis) SubscribeResilient(ctx context.Context, db int, channels, patterns []string, handler MessageHandler) error {
+	if len(channels) == 0 && len(patterns) == 0 {
+		return fmt.Errorf("channels 和 patterns 不允许同时为空")
+	}
+	backoff := resubscribeMinBackoff
+	for {
+		established, err := p.subscribeSession(ctx, db, channels, patterns, handler)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if established {
+			backoff = resubscribeMinBackoff
+		}
+		p.logf("redis subscribe: db=%d 连接断开，%v后重连 channels=%v patterns=%v: %v", db, backoff, channels, patterns, err)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > resubscribeMaxBackoff {
+			backoff = resubscribeMaxBackoff
+		}
+	}
+}
+
+// 在一个新连接上完成一次订阅并接收消息，直到ctx取消（返回nil）或连接出错
+// established表示订阅是否已成功建立
+func (p *Redis) subscribeSession(ctx context.Context, db int, channels, patterns []string, handler MessageHandler) (established bool, err error) {
+	conn, err := p.borrow(p.pool, db)
+	if err != nil {
+		return false, err
+	}
+	psc := redis.PubSubConn{Conn: conn}
+	defer psc.Close()
+
+	if len(channels) > 0 {
+		if err := psc.Subscribe(redis.Args{}.AddFlat(channels)...); err != nil {
+			return false, err
+		}
+	}
+	if len(patterns) > 0 {
+		if err := psc.PSubscribe(redis.Args{}.AddFlat(patterns)...); err != nil {
+			return false, err
+		}
+	}
+
+	defer unsubscribeOnDone(ctx, psc)()
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			handler(v.Channel, v.Data)
+		case redis.Subscription:
+			established = true
+			p.logSubscription(db, v)
+			if v.Count == 0 {
+				return true, nil
+			}
+		case error:
+			if ctx.Err() != nil {
+				return established, nil
+			}
+			p.logf("redis subscribe: db=%d 接收出错: %v", db, v)
+			return established, v
+		}
+	}
+}
+
+type pubsubMessage struct {
+	channel string
+	payload []byte
+}
+
+// 并发处理订阅消息，keyFn返回相同key的消息总是由同一个worker按顺序处理
+func (p *Redis) SubscribeKeyedConcurrent(ctx context.Context, db int, channels []string, workers int, keyFn func(payload []byte) string, handler MessageHandler) error {
+	if workers <= 0 {
+		return fmt.Errorf("workers 必须大于0")
+	}
+
+	queues := make([]chan pubsubMessage, workers)
+	var wg sync.WaitGroup
+	for i := range queues {
+		queues[i] = make(chan pubsubMessage, 64)
+		wg.Add(1)
+		go func(queue chan pubsubMessage) {
+			defer wg.Done()
+			for msg := range queue {
+				handler(msg.channel, msg.payload)
+			}
+		}(queues[i])
+	}
+
+	err := p.Subscribe(ctx, db, channels, func(channel string, payload []byte) {
+		h := fnv.New32a()
+		h.Write([]byte(keyFn(payload)))
+		queues[h.Sum32()%uint32(workers)] <- pubsubMessage{channel, payload}
+	})
+
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+	return err
+}
+
+// 按消息信封的type字段分发订阅消息，信封格式 {"type":"...","data":{...}}
+// 使用方式: p.Subscribe(ctx, db, channels, router.Handle)
+type Router struct {
+	mu       sync.RWMutex
+	handlers map[string]func(data json.RawMessage)
+}
+
+type envelope struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+func NewRouter() *Router {
+	return &Router{handlers: make(map[string]func(data json.RawMessage))}
+}
+
+// 注册消息类型的处理函数，重复注册会覆盖
+func (r *Router) On(msgType string, handler func(data json.RawMessage)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[msgType] = handler
+}
+
+// 解析信封并调用对应的处理函数，无法解析或未注册的类型直接丢弃
+func (r *Router) Handle(channel string, payload []byte) {
+	var env envelope
+	if err := json.Unmarshal(payload, &env); err != nil {
+		return
+	}
+	r.mu.RLock()
+	handler, ok := r.handlers[env.Type]
+	r.mu.RUnlock()
+	if ok {
+		handler(env.Data)
+	}
+}
+
+// 订阅消息去重：idFn提取消息ID，最近size个ID内重复的消息会被跳过，ID为空的消息不去重
+// 返回的处理函数可直接传给Subscribe等订阅方法
+func DedupHandler(idFn func(payload []byte) string, size int, handler MessageHandler) MessageHandler {
+	seen := newLRUSet(size)
+	return func(channel string, payload []byte) {
+		if id := idFn(payload); id != "" && !seen.add(id) {
+			return
+		}
+		handler(channel, payload)
+	}
+}
+
+// 容量固定的LRU集合
+type lruSet struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+func newLRUSet(size int) *lruSet {
+	if size <= 0 {
+		size = 1
+	}
+	return &lruSet{size: size, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+// 加入集合，已存在时返回false
+func (s *lruSet) add(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.items[id]; ok {
+		s.order.MoveToFront(e)
+		return false
+	}
+	s.items[id] = s.order.PushFront(id)
+	if s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.items, oldest.Value.(string))
+	}
+	return true
+}
+
+// 频道对应的回放stream
+func replayStreamKey(channel string) string {
+	return channel + ":replay"
+}
+
+// 追加到回放stream并发布，发布的消息格式为 "\0<stream消息ID>\0<payload>"
+// 以NUL开头并分隔，避免与普通PUBLISH的文本消息混淆
+var publishWithReplayScript = redis.NewScript(1, `
+local id = redis.call('XADD', KEYS[1], 'MAXLEN', '~', ARGV[3], '*', 'payload', ARGV[2])
+redis.call('PUBLISH', ARGV[1], '\0' .. id .. '\0' .. ARGV[2])
+return id
+`)
+
+// 发布消息并保存到回放stream（最多保留约maxLen条），配合SubscribeWithReplay使用
+func (p *Redis) PublishWithReplay(db int, channel string, payload []byte, maxLen int64) error {
+	_, err := p.doScript(db, publishWithReplayScript, replayStreamKey(channel), channel, payload, maxLen)
+	return err
+}
+
+// 先回放stream中最近replayN条消息，再接收实时消息；回放与实时消息重叠的部分会被去重
+// 需要发布方使用PublishWithReplay，普通PUBLISH的消息原样交给handler
+func (p *Redis) SubscribeWithReplay(ctx context.Context, db int, channel string, replayN int, handler MessageHandler) error {
+	conn, err := p.borrow(p.pool, db)
+	if err != nil {
+		return err
+	}
+	psc := redis.PubSubConn{Conn: conn}
+	defer psc.Close()
+
+	// 先订阅再回放，保证回放期间发布的消息不会丢失
+	if err := psc.Subscribe(channel); err != nil {
+		return err
+	}
+	for subscribed := false; !subscribed; {
+		switch v := psc.Receive().(type) {
+		case redis.Subscription:
+			subscribed = true
+			p.logSubscription(db, v)
+		case error:
+			return v
+		}
+	}
+
+	defer unsubscribeOnDone(ctx, psc)()
+
+	lastID := ""
+	if replayN > 0 {
+		messages, err := parseStreamMessages(p.Do(db, "XREVRANGE", replayStreamKey(channel), "+", "-", "COUNT", replayN))
+		if err != nil {
+			return err
+		}
+		for i := len(messages) - 1; i >= 0; i-- {
+			handler(channel, []byte(messages[i].Values["payload"]))
+		}
+		if len(messages) > 0 {
+			lastID = messages[0].ID
+		}
+	}
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			id, payload := splitReplayMessage(v.Data)
+			if id != "" && lastID != "" && compareStreamID(id, lastID) <= 0 {
+				continue
+			}
+			handler(v.Channel, payload)
+		case redis.Subscription:
+			p.logSubscription(db, v)
+			if v.Count == 0 {
+				return nil
+			}
+		case error:
+			if ctx.Err() != nil {
+				return nil
+			}
+			p.logf("redis subscribe: db=%d 接收出错: %v", db, v)
+			return v
+		}
+	}
+}
+
+// 拆分PublishWithReplay发布的消息，不是该格式时id为空、data原样返回
+func splitReplayMessage(data []byte) (string, []byte) {
+	if len(data) == 0 || data[0] != 0 {
+		return "", data
+	}
+	i := bytes.IndexByte(data[1:], 0)
+	if i < 0 {
+		return "", data
+	}
+	id := string(data[1 : i+1])
+	if !isStreamID(id) {
+		return "", data
+	}
+	return id, data[i+2:]
+}
+
+// 是否为完整的stream消息ID，即 <数字>-<数字>
+func isStreamID(id string) bool {
+	i := strings.IndexByte(id, '-')
+	return i > 0 && isDigits(id[:i]) && isDigits(id[i+1:])
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Request发布的请求消息，响应方处理后应发布回复到ReplyTo频道
+type RequestMessage struct {
+	ReplyTo string `json:"reply_to"`
+	Payload []byte `json:"payload"`
+}
+
+// 解析Request发布的请求消息
+func ParseRequest(payload []byte) (RequestMessage, error) {
+	var req RequestMessage
+	err := json.Unmarshal(payload, &req)
+	return req, err
+}
+
+// 回复Request的请求
+func (p *Redis) Reply(db int, req RequestMessage, payload []byte) error {
+	if req.ReplyTo == "" {
+		return fmt.Errorf("请求没有回复频道")
+	}
+	_, err := p.Do(db, "PUBLISH", req.ReplyTo, payload)
+	return err
+}
+
+// 基于pubsub的请求/回复：先订阅回复频道，再向reqChannel发布请求，等待第一条回复
+// replyTo为空时自动生成唯一的回复频道
+func (p *Redis) Request(ctx context.Context, db int, reqChannel string, payload []byte, replyTo string, timeout time.Duration) ([]byte, error) {
+	if replyTo == "" {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		replyTo = reqChannel + ":reply:" + hex.EncodeToString(b)
+	}
+	msg, err := json.Marshal(RequestMessage{ReplyTo: replyTo, Payload: payload})
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := p.borrow(p.pool, db)
+	if err != nil {
+		return nil, err
+	}
+	psc := redis.PubSubConn{Conn: conn}
+	defer psc.Close()
+
+	// 订阅成功后再发布，避免回复早于订阅而丢失
+	if err := psc.Subscribe(replyTo); err != nil {
+		return nil, err
+	}
+	for subscribed := false; !subscribed; {
+		switch v := psc.Receive().(type) {
+		case redis.Subscription:
+			subscribed = true
+		case error:
+			return nil, v
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	defer unsubscribeOnDone(ctx, psc)()
+
+	if _, err := p.Do(db, "PUBLISH", reqChannel, msg); err != nil {
+		return nil, err
+	}
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			return v.Data, nil
+		case redis.Subscription:
+			if v.Count == 0 {
+				return nil, requestError(ctx)
+			}
+		case error:
+			if ctx.Err() != nil {
+				return nil, requestError(ctx)
+			}
+			return nil, v
+		}
+	}
+}
+
+func requestError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("等待回复超时")
+	}
+	return ctx.Err()
+}
+
+// gzip压缩后发布，订阅方使用DecompressHandler解压
+func (p *Redis) PublishCompressed(db int, channel string, payload []byte) error {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	_, err := p.Do(db, "PUBLISH", channel, buf.Bytes())
+	return err
+}
+
+// 对gzip压缩的消息(以gzip魔数0x1f 0x8b开头)解压后再交给handler，未压缩的消息原样传递
+// 解压失败的消息会被丢弃
+func DecompressHandler(handler MessageHandler) MessageHandler {
+	return func(channel string, payload []byte) {
+		if len(payload) < 2 || payload[0] != 0x1f || payload[1] != 0x8b {
+			handler(channel, payload)
+			return
+		}
+		r, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return
+		}
+		handler(channel, data)
+	}
+}
+
+// 层级频道名各段之间的分隔符，如"orders.us.created"
+const topicSeparator = "."
+
+// 检查层级频道名的各段：不允许为空，也不允许包含分隔符
+func CheckTopic(parts ...string) error {
+	if len(parts) == 0 {
+		return fmt.Errorf("topic 不允许为空")
+	}
+	for i, part := range parts {
+		if part == "" {
+			return fmt.Errorf("topic 第%d段为空", i+1)
+		}
+		if strings.Contains(part, topicSeparator) {
+			return fmt.Errorf("topic 第%d段包含分隔符: %s", i+1, part)
+		}
+	}
+	return nil
+}
+
+// 用分隔符拼接层级频道名，用于PUBLISH/SUBSCRIBE；各段可先用CheckTopic检查
+func Topic(parts ...string) string {
+	return strings.Join(parts, topicSeparator)
+}
+
+// 构造PSUBSCRIBE模式：值为"*"或"?"的段作为通配符，其余段转义glob元字符后按字面匹配
+// 例如TopicPattern("orders", "*", "created")；注意"*"也能匹配分隔符，可跨越多段
+func TopicPattern(parts ...string) string {
+	segments := make([]string, len(parts))
+	for i, part := range parts {
+		if part == "*" || part == "?" {
+			segments[i] = part
+		} else {
+			segments[i] = escapeGlob(part)
+		}
+	}
+	return strings.Join(segments, topicSeparator)
+}
@@ -0,0 +1,184 @@
+package redis
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 集群槽位数量
+const clusterSlots = 16384
+
+// 首个参数不是key的命令，重定向时不计算槽位，发往主连接池
+var keylessCommands = map[string]bool{
+	"ACL": true, "AUTH": true, "BGREWRITEAOF": true, "BGSAVE": true, "BITOP": true, "BLMPOP": true,
+	"BZMPOP": true, "CLIENT": true, "CLUSTER": true, "COMMAND": true, "CONFIG": true, "DBSIZE": true,
+	"DEBUG": true, "ECHO": true, "EVAL": true, "EVALSHA": true, "EVAL_RO": true, "EVALSHA_RO": true,
+	"EXEC": true, "FCALL": true, "FCALL_RO": true, "FLUSHALL": true, "FLUSHDB": true, "FUNCTION": true,
+	"HELLO": true, "INFO": true, "LASTSAVE": true, "LATENCY": true, "LMPOP": true, "MIGRATE": true,
+	"MONITOR": true, "MULTI": true, "PING": true, "PSUBSCRIBE": true, "PUBLISH": true, "PUBSUB": true,
+	"PUNSUBSCRIBE": true, "RANDOMKEY": true, "READONLY": true, "REPLICAOF": true, "ROLE": true,
+	"SAVE": true, "SCAN": true, "SCRIPT": true, "SELECT": true, "SHUTDOWN": true, "SINTERCARD": true,
+	"SLAVEOF": true, "SLOWLOG": true, "SUBSCRIBE": true, "SWAPDB": true, "TIME": true, "UNSUBSCRIBE": true,
+	"UNWATCH": true, "WAIT": true, "XREAD": true, "XREADGROUP": true, "ZDIFF": true, "ZINTER": true,
+	"ZINTERCARD": true, "ZMPOP": true, "ZUNION": true,
+}
+
+// 第二个参数为key的子命令形式，如 OBJECT ENCODING key、XINFO STREAM key
+var subcommandKeyCommands = map[string]bool{
+	"MEMORY": true, "OBJECT": true, "XINFO": true,
+}
+
+// 计算命令中key所在的槽位，命令不包含可用于路由的key时返回-1
+func commandSlot(command string, args []interface{}) int {
+	name := strings.ToUpper(command)
+	index := 0
+	if subcommandKeyCommands[name] {
+		index = 1
+	} else if keylessCommands[name] {
+		return -1
+	}
+	if len(args) <= index {
+		return -1
+	}
+	switch key := args[index].(type) {
+	case string:
+		return keySlot([]byte(key))
+	case []byte:
+		return keySlot(key)
+	}
+	return -1
+}
+
+// 按MOVED重定向执行命令：包含key的命令优先发往缓存的槽位节点，收到MOVED后更新缓存并重试一次
+func (p *Redis) doFollowRedirects(db int, command string, args ...interface{}) (interface{}, error) {
+	slot := commandSlot(command, args)
+	addr := ""
+	if slot >= 0 {
+		addr = p.slotNode(slot)
+	}
+	for attempt := 0; ; attempt++ {
+		var reply interface{}
+		var err error
+		if addr == "" {
+			reply, err = p.doOnce(db, command, args...)
+		} else {
+			reply, err = p.doOnNode(addr, db, command, args...)
+		}
+
+		movedSlot, movedAddr, moved := parseMoved(err)
+		if !moved || attempt > 0 {
+			return reply, err
+		}
+		p.setSlotNode(movedSlot, movedAddr)
+		addr = movedAddr
+	}
+}
+
+func (p *Redis) doOnNode(addr string, db int, command string, args ...interface{}) (interface{}, error) {
+	pool, err := p.nodePool(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := p.borrow(pool, db)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.Do(command, args...)
+}
+
+func (p *Redis) slotNode(slot int) string {
+	p.redirectMu.Lock()
+	defer p.redirectMu.Unlock()
+	return p.slotNodes[slot]
+}
+
+func (p *Redis) setSlotNode(slot int, addr string) {
+	p.redirectMu.Lock()
+	defer p.redirectMu.Unlock()
+	if p.slotNodes == nil {
+		p.slotNodes = make(map[int]string)
+	}
+	p.slotNodes[slot] = addr
+}
+
+// 获取节点的连接池，不存在时使用相同配置创建
+func (p *Redis) nodePool(addr string) (*redis.Pool, error) {
+	p.redirectMu.Lock()
+	defer p.redirectMu.Unlock()
+	if pool, ok := p.nodePools[addr]; ok {
+		return pool, nil
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	cfg := p.config
+	cfg.Host, cfg.Port = host, port
+	cfg.SentinelAddrs = nil
+	pool := p.newPool(cfg)
+	if p.nodePools == nil {
+		p.nodePools = make(map[string]*redis.Pool)
+	}
+	p.nodePools[addr] = pool
+	return pool, nil
+}
+
+func (p *Redis) closeNodePools() {
+	p.redirectMu.Lock()
+	defer p.redirectMu.Unlock()
+	for _, pool := range p.nodePools {
+		pool.Close()
+	}
+	p.nodePools = nil
+}
+
+// 解析 "MOVED <slot> <host:port>" 错误
+func parseMoved(err error) (int, string, bool) {
+	e, ok := err.(redis.Error)
+	if !ok {
+		return 0, "", false
+	}
+	fields := strings.Fields(string(e))
+	if len(fields) != 3 || fields[0] != "MOVED" {
+		return 0, "", false
+	}
+	slot, convErr := strconv.Atoi(fields[1])
+	if convErr != nil {
+		return 0, "", false
+	}
+	return slot, fields[2], true
+}
+
+// 计算key所在的集群槽位，支持{hashtag}
+func keySlot(key []byte) int {
+	if start := strings.IndexByte(string(key), '{'); start >= 0 {
+		if end := strings.IndexByte(string(key[start+1:]), '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % clusterSlots
+}
+
+// CRC16-CCITT(XMODEM)，与redis集群使用的算法一致
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
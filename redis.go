@@ -1,55 +1,250 @@
 package redis
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
 )
 
 type Redis struct {
-	pool *redis.Pool
+	pool    *redis.Pool
+	replica *redis.Pool
+	config  Config
+
+	// 为true时删除类操作只通过Logger记录将要删除的keys，不实际删除
+	// 包括删除类的辅助方法，以及通过Do执行的DEL/UNLINK/FLUSHDB/FLUSHALL；Tx、Pipeline和脚本中的命令不受影响
+	DryRun bool
+
+	swrFlight sync.Map // GetSWR中正在后台刷新的key
+
+	redirectMu sync.Mutex
+	slotNodes  map[int]string         // 槽位 -> 节点地址，由MOVED重定向得到
+	nodePools  map[string]*redis.Pool // 重定向节点的连接池
+
+	masterAddr atomic.Value // 配置Sentinel时当前主节点的地址，连接到其他地址的空闲连接在取出时被丢弃
+
+	leaks   *leakDetector
+	results resultCache // CachedDo的结果缓存
+}
+
+// 连接配置
+type Config struct {
+	Host     string
+	Port     int
+	Username string // ACL用户名(Redis 6+)，为空时使用单密码AUTH
+	Password string
+	MaxConn  int // 最大连接数，0为不限制
+	MaxIdle  int // 最大空闲连接数
+
+	// 连接的最长存活时间，超过后在下次取出时关闭并重新建立，0为不限制
+	// 应小于服务端timeout配置，避免使用已被服务端断开的连接
+	MaxConnLifetime time.Duration
+
+	// 新建连接并完成AUTH后调用，用于CLIENT SETNAME等连接级初始化；返回错误则放弃该连接
+	OnConnect func(conn redis.Conn) error
+	// 连接被关闭时调用
+	OnClose func()
+
+	// 每次从任意连接池(主库、从库、重定向节点)取出连接时执行的命令，在切换db之前执行
+	OnBorrow []Command
+	// 只在从InitReplica的从库连接池取出连接时执行的命令，如集群副本上的READONLY；在OnBorrow之后执行
+	ReplicaOnBorrow []Command
+
+	// 收到MOVED重定向时连接到对应节点重试一次，并缓存槽位对应的节点
+	FollowRedirects bool
+
+	// 日志输出，可直接使用log.Printf；为空时不输出
+	Logger func(format string, args ...interface{})
+
+	// HGetAll/HLEN发现hash字段数超过该值时通过Logger告警，0为不检查
+	WarnHashFields int
+
+	// 为true时类型相关的操作先执行TYPE检查，类型不符返回*ErrWrongType；会多一次往返，建议只在测试环境开启
+	TypeCheck bool
+
+	// 为true时Init不预先建立连接检查，连接和认证错误推迟到第一次执行命令时返回
+	LazyInit bool
+
+	// Do遇到LOADING/MASTERDOWN等临时错误时的最大重试次数，0为不重试
+	MaxRetries int
+	// 首次重试前的等待时间，之后每次翻倍，默认100ms
+	RetryBackoff time.Duration
+
+	// 配置后通过Sentinel查询MasterName的主节点地址，忽略Host和Port；每次新建连接时重新查询
+	SentinelAddrs []string
+	MasterName    string
+	// 配置了Sentinel时，Do遇到连接错误后重新查询主节点并重试一次，用于主从切换期间自动恢复
+	// 命令可能已在旧主节点执行，非幂等的命令可能被执行两次
+	FailoverRetry bool
+
+	// ZAddTime/ZRangeByTime中分数的时间单位，分数为Unix时间除以该值，默认time.Millisecond
+	// zset分数为double，使用time.Nanosecond时当前时间会损失约百纳秒的精度
+	TimeScorePrecision time.Duration
+}
+
+// 开启TypeCheck时，key的实际类型与操作要求的类型不符
+type ErrWrongType struct {
+	Key  string
+	Got  string
+	Want string
+}
+
+func (e *ErrWrongType) Error() string {
+	return fmt.Sprintf("key %s 的类型为 %s，操作需要 %s", e.Key, e.Got, e.Want)
+}
+
+// 开启TypeCheck时检查key类型，key不存在时不报错
+func (p *Redis) checkType(db int, key, want string) error {
+	if !p.config.TypeCheck {
+		return nil
+	}
+	got, err := redis.String(p.Do(db, "TYPE", key))
+	if err != nil {
+		return err
+	}
+	if got != "none" && got != want {
+		return &ErrWrongType{Key: key, Got: got, Want: want}
+	}
+	return nil
 }
 
+// 认证失败，可用errors.Is判断
+var ErrAuthFailed = errors.New("redis认证失败")
+
+// 默认的重试等待时间
+const defaultRetryBackoff = 100 * time.Millisecond
+
 // redis连接池
-func (p *Redis) newPool(host string, port int, password string, maxConn, maxIdle int) *redis.Pool {
+func (p *Redis) newPool(cfg Config) *redis.Pool {
 	return &redis.Pool{
-		MaxActive:   maxConn,
-		MaxIdle:     maxIdle,
-		IdleTimeout: 10 * time.Second,
+		MaxActive:       cfg.MaxConn,
+		MaxIdle:         cfg.MaxIdle,
+		IdleTimeout:     10 * time.Second,
+		MaxConnLifetime: cfg.MaxConnLifetime,
 		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", fmt.Sprintf("%v:%v", host, port))
+			addr, err := dialAddr(cfg)
+			if err != nil {
+				return nil, err
+			}
+			sentinel := len(cfg.SentinelAddrs) > 0
+			if sentinel {
+				p.masterAddr.Store(addr)
+			}
+			c, err := redis.Dial("tcp", addr)
 			if err != nil {
 				return nil, err
 			}
-			if password != "" {
-				if _, err := c.Do("AUTH", password); err != nil {
+			if cfg.Username != "" {
+				if _, err := c.Do("AUTH", cfg.Username, cfg.Password); err != nil {
+					c.Close()
+					return nil, fmt.Errorf("%w: %v", ErrAuthFailed, err)
+				}
+			} else if cfg.Password != "" {
+				if _, err := c.Do("AUTH", cfg.Password); err != nil {
+					c.Close()
+					return nil, fmt.Errorf("%w: %v", ErrAuthFailed, err)
+				}
+			}
+			if cfg.OnConnect != nil {
+				if err := cfg.OnConnect(c); err != nil {
 					c.Close()
 					return nil, err
 				}
 			}
+			if cfg.OnClose != nil {
+				c = &hookConn{Conn: c, onClose: cfg.OnClose}
+			}
+			if sentinel {
+				c = &masterConn{Conn: c, addr: addr}
+			}
 			return c, err
 		},
 		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if mc, ok := c.(*masterConn); ok && mc.addr != p.currentMaster() {
+				return fmt.Errorf("主节点已切换到 %s", p.currentMaster())
+			}
 			_, err := c.Do("PING")
 			return err
 		},
 	}
 }
 
+// 一条redis命令
+type Command struct {
+	Name string
+	Args []interface{}
+}
+
+// 关闭时调用OnClose的连接
+type hookConn struct {
+	redis.Conn
+	onClose func()
+}
+
+func (c *hookConn) Close() error {
+	err := c.Conn.Close()
+	c.onClose()
+	return err
+}
+
+func (p *Redis) logf(format string, args ...interface{}) {
+	if p.config.Logger != nil {
+		p.config.Logger(format, args...)
+	}
+}
+
 // 初始化
 func (p *Redis) Init(host string, port int, password string, maxConn, maxIdle int) error {
-	p.pool = p.newPool(host, port, password, maxConn, maxIdle)
+	return p.InitWithConfig(Config{
+		Host:     host,
+		Port:     port,
+		Password: password,
+		MaxConn:  maxConn,
+		MaxIdle:  maxIdle,
+	})
+}
+
+// 使用配置初始化
+func (p *Redis) InitWithConfig(cfg Config) error {
+	p.config = cfg
+	p.pool = p.newPool(cfg)
 	if p.pool == nil {
 		return errors.New("redis初始化失败！")
 	}
+	if cfg.LazyInit {
+		return nil
+	}
+
+	// 预先建立一个连接，地址或密码错误时在初始化阶段就返回
+	conn := p.pool.Get()
+	_, err := conn.Do("PING")
+	conn.Close()
+	if err != nil {
+		p.pool.Close()
+		return err
+	}
 	return nil
 }
 
 // 最后需要调用关闭连接
 func (p *Redis) Close() error {
+	if p.replica != nil {
+		p.replica.Close()
+	}
+	p.closeNodePools()
+	if p.leaks != nil {
+		p.leaks.close()
+	}
 	return p.pool.Close()
 }
 
@@ -57,6 +252,11 @@ func (p *Redis) GetString(db int, key string) (string, error) {
 	return redis.String(p.Do(db, "GET", key))
 }
 
+// 读取值并将过期时间重置为extend（GETEX，Redis 6.2+），用于访问即续期的会话
+func (p *Redis) GetStringSliding(db int, key string, extend time.Duration) (string, error) {
+	return redis.String(p.Do(db, "GETEX", key, "PX", toMillis(extend)))
+}
+
 func (p *Redis) GetInt(db int, key string) (int, error) {
 	return redis.Int(p.Do(db, "GET", key))
 }
@@ -69,13 +269,143 @@ func (p *Redis) IsKeyExist(db int, key string) (int, error) {
 	return redis.Int(p.Do(db, "EXISTS", key))
 }
 
+// 以下为[]byte类型key的版本，用于哈希ID等二进制key
+func (p *Redis) GetStringBytes(db int, key []byte) (string, error) {
+	return redis.String(p.Do(db, "GET", key))
+}
+
+func (p *Redis) GetIntBytes(db int, key []byte) (int, error) {
+	return redis.Int(p.Do(db, "GET", key))
+}
+
+func (p *Redis) GetInt64Bytes(db int, key []byte) (int64, error) {
+	return redis.Int64(p.Do(db, "GET", key))
+}
+
+func (p *Redis) IsKeyExistBytes(db int, key []byte) (int, error) {
+	return redis.Int(p.Do(db, "EXISTS", key))
+}
+
 func (p *Redis) Do(db int, command string, args ...interface{}) (interface{}, error) {
-	conn := p.pool.Get()
+	if p.DryRun {
+		if reply, ok, err := p.dryRunDo(db, command, args); ok {
+			return reply, err
+		}
+	}
+	reply, err := p.doRetry(db, command, args...)
+	p.invalidateResults(db, command, args)
+	return reply, err
+}
+
+// 执行命令，遇到临时错误时按MaxRetries重试，配置FailoverRetry时连接错误后重新查询主节点重试一次
+// 不触发CachedDo的缓存失效
+func (p *Redis) doRetry(db int, command string, args ...interface{}) (interface{}, error) {
+	backoff := p.config.RetryBackoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		reply, err := p.doRoute(db, command, args...)
+		if p.config.FailoverRetry && len(p.config.SentinelAddrs) > 0 && isConnError(err) {
+			reply, err = p.doFailover(db, command, args, err)
+		}
+		if attempt >= p.config.MaxRetries || !isTransientErr(err) {
+			return reply, err
+		}
+		p.logf("redis: %s 临时错误，%v后重试: %v", command, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// DryRun时拦截删除命令，只记录并返回与实际执行相同类型的结果：DEL/UNLINK返回将被删除的数量
+// ok为false表示不是删除命令，需要正常执行
+func (p *Redis) dryRunDo(db int, command string, args []interface{}) (reply interface{}, ok bool, err error) {
+	switch strings.ToUpper(command) {
+	case "DEL", "UNLINK":
+		n, err := redis.Int64(p.doRoute(db, "EXISTS", args...))
+		if err != nil {
+			return nil, true, err
+		}
+		p.logf("redis dry-run: %s db=%d keys=%v 将删除%d个", strings.ToUpper(command), db, args, n)
+		return n, true, nil
+	case "FLUSHDB":
+		n, err := redis.Int64(p.doRoute(db, "DBSIZE"))
+		if err != nil {
+			return nil, true, err
+		}
+		p.logf("redis dry-run: FLUSHDB db=%d 将删除%d个key", db, n)
+		return "OK", true, nil
+	case "FLUSHALL":
+		p.logf("redis dry-run: FLUSHALL")
+		return "OK", true, nil
+	}
+	return nil, false, nil
+}
+
+func (p *Redis) doRoute(db int, command string, args ...interface{}) (interface{}, error) {
+	if p.config.FollowRedirects {
+		return p.doFollowRedirects(db, command, args...)
+	}
+	return p.doOnce(db, command, args...)
+}
+
+// 从库加载数据(LOADING)或主从切换中(MASTERDOWN)的错误是临时的，可以重试
+func isTransientErr(err error) bool {
+	e, ok := err.(redis.Error)
+	if !ok {
+		return false
+	}
+	return strings.HasPrefix(string(e), "LOADING ") || strings.HasPrefix(string(e), "MASTERDOWN ")
+}
+
+func (p *Redis) doOnce(db int, command string, args ...interface{}) (interface{}, error) {
+	conn, err := p.borrowConn(db)
+	if err != nil {
+		return nil, err
+	}
 	defer conn.Close()
-	conn.Do("select", db)
 	return conn.Do(command, args...)
 }
 
+// 从连接池获取连接并切换到指定db，使用完需要Close；通过该连接的写命令会使CachedDo中对应key的缓存失效
+func (p *Redis) getConn(db int) (redis.Conn, error) {
+	conn, err := p.borrowConn(db)
+	if err != nil {
+		return nil, err
+	}
+	return p.invalidating(conn, db), nil
+}
+
+// 取出主库连接，写命令不会使CachedDo的缓存失效，只用于自行处理失效的Do
+func (p *Redis) borrowConn(db int) (redis.Conn, error) {
+	conn, err := p.borrow(p.pool, db)
+	if err != nil || p.leaks == nil {
+		return conn, err
+	}
+	return p.leaks.track(conn), nil
+}
+
+// 从指定连接池取出连接，执行OnBorrow(从库还有ReplicaOnBorrow)命令后切换到指定db
+func (p *Redis) borrow(pool *redis.Pool, db int) (redis.Conn, error) {
+	conn := pool.Get()
+	commands := p.config.OnBorrow
+	if pool == p.replica && len(p.config.ReplicaOnBorrow) > 0 {
+		commands = append(commands[:len(commands):len(commands)], p.config.ReplicaOnBorrow...)
+	}
+	for _, cmd := range commands {
+		if _, err := conn.Do(cmd.Name, cmd.Args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if _, err := conn.Do("SELECT", db); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
 // hash设置多项
 func (p *Redis) HMSet(db int, key string, values map[string]interface{}) error {
 	args := []interface{}{key}
@@ -90,8 +420,68 @@ func (p *Redis) HMSet(db int, key string, values map[string]interface{}) error {
 	return err
 }
 
-// 获取hash所有的值
+// hash设置多项并让这些字段在ttl后一起过期（字段级过期），需要Redis 7.4+
+// 优先使用HSETEX(Redis 8.0)，不支持时在事务中使用HSET+HPEXPIRE
+func (p *Redis) HSetEx(db int, key string, ttl time.Duration, values map[string]interface{}) error {
+	if len(values) == 0 {
+		return fmt.Errorf("values 不允许为空")
+	}
+	fields := make([]string, 0, len(values))
+	pairs := redis.Args{}
+	for k, v := range values {
+		fields = append(fields, k)
+		pairs = pairs.Add(k, v)
+	}
+	ms := toMillis(ttl)
+
+	conn, err := p.getConn(db)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("HSETEX", redis.Args{}.Add(key, "PX", ms, "FIELDS", len(fields)).AddFlat(pairs)...)
+	if !isUnknownCommand(err) {
+		return err
+	}
+
+	conn.Send("MULTI")
+	conn.Send("HSET", redis.Args{}.Add(key).AddFlat(pairs)...)
+	conn.Send("HPEXPIRE", redis.Args{}.Add(key, ms, "FIELDS", len(fields)).AddFlat(fields)...)
+	if _, err := conn.Do("EXEC"); err != nil {
+		if e, ok := err.(redis.Error); ok && strings.HasPrefix(string(e), "EXECABORT") {
+			return fmt.Errorf("redis服务器不支持hash字段过期(需要7.4+): %v", err)
+		}
+		return err
+	}
+	return nil
+}
+
+// 是否为服务器不支持的命令
+func isUnknownCommand(err error) bool {
+	e, ok := err.(redis.Error)
+	return ok && strings.HasPrefix(string(e), "ERR unknown command")
+}
+
+// HGetAll的v不是指向struct的非nil指针，可用errors.Is判断
+var ErrInvalidScanTarget = errors.New("HGetAll的目标必须是指向struct的非nil指针")
+
+func checkScanTarget(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("%w: %T", ErrInvalidScanTarget, v)
+	}
+	return nil
+}
+
+// 获取hash所有的值，v需为指向struct的指针
 func (p *Redis) HGetAll(db int, key string, v interface{}) (bool, error) {
+	if err := checkScanTarget(v); err != nil {
+		return false, err
+	}
+	if err := p.checkType(db, key, "hash"); err != nil {
+		return false, err
+	}
 	exist, err := redis.Bool(p.Do(db, "EXISTS", key))
 	if err != nil || !exist {
 		return exist, err
@@ -100,22 +490,134 @@ func (p *Redis) HGetAll(db int, key string, v interface{}) (bool, error) {
 	if err != nil {
 		return true, err
 	}
+	p.checkHashFields(db, key, int64(len(result)/2))
 	if err := redis.ScanStruct(result, v); err != nil {
 		return true, err
 	}
 	return true, nil
 }
 
+// 删除hash字段，同时返回hash是否已被删空（管道中一并执行HLEN）
+func (p *Redis) HDelAndReport(db int, key string, fields ...string) (deleted int64, hashRemoved bool, err error) {
+	if len(fields) == 0 {
+		return 0, false, fmt.Errorf("fields 不允许为空")
+	}
+	conn, err := p.getConn(db)
+	if err != nil {
+		return 0, false, err
+	}
+	defer conn.Close()
+
+	conn.Send("HDEL", redis.Args{}.Add(key).AddFlat(fields)...)
+	conn.Send("HLEN", key)
+	if err := conn.Flush(); err != nil {
+		return 0, false, err
+	}
+	deleted, err = redis.Int64(conn.Receive())
+	length, lenErr := redis.Int64(conn.Receive())
+	if err != nil {
+		return 0, false, err
+	}
+	if lenErr != nil {
+		return deleted, false, lenErr
+	}
+	return deleted, length == 0, nil
+}
+
+// 获取hash所有字段，返回字段到值的map；key不存在时返回空map
+func (p *Redis) HGetAllMap(db int, key string) (map[string]string, error) {
+	if err := p.checkType(db, key, "hash"); err != nil {
+		return nil, err
+	}
+	values, err := redis.StringMap(p.Do(db, "HGETALL", key))
+	if err != nil {
+		return nil, err
+	}
+	p.checkHashFields(db, key, int64(len(values)))
+	return values, nil
+}
+
+// 获取数值型hash的所有字段，值解析为int64；skipInvalid为true时跳过非数值字段，否则返回错误
+func (p *Redis) HGetAllInt64(db int, key string, skipInvalid bool) (map[string]int64, error) {
+	values, err := p.HGetAllMap(db, key)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]int64, len(values))
+	for field, value := range values {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			if skipInvalid {
+				continue
+			}
+			return nil, fmt.Errorf("hash %s 字段 %s 的值不是整数: %q", key, field, value)
+		}
+		result[field] = n
+	}
+	return result, nil
+}
+
+func (p *Redis) HLEN(db int, key string) (int64, error) {
+	if err := p.checkType(db, key, "hash"); err != nil {
+		return 0, err
+	}
+	n, err := redis.Int64(p.Do(db, "HLEN", key))
+	if err != nil {
+		return 0, err
+	}
+	p.checkHashFields(db, key, n)
+	return n, nil
+}
+
+// hash字段数超过WarnHashFields时告警，用于发现无限增长的hash
+func (p *Redis) checkHashFields(db int, key string, n int64) {
+	if p.config.WarnHashFields > 0 && n > int64(p.config.WarnHashFields) {
+		p.logf("redis: hash字段数过多 db=%d key=%s fields=%d", db, key, n)
+	}
+}
+
 // 设置列表元素
 func (p *Redis) LPUSH(db int, key string, v interface{}) error {
-	if _, ok := v.(string); ok {
-		_, err := p.Do(db, "LPUSH", key, v)
+	value, err := encodeValue(v)
+	if err != nil {
 		return err
-	} else {
-		bytes, _ := json.Marshal(v)
-		_, err := p.Do(db, "LPUSH", key, string(bytes))
+	}
+	_, err = p.Do(db, "LPUSH", key, value)
+	return err
+}
+
+// 设置列表元素并裁剪到最多maxLen个（事务中执行），列表长度不会超过maxLen
+func (p *Redis) LPushCapped(db int, key string, maxLen int64, v interface{}) error {
+	if maxLen <= 0 {
+		return fmt.Errorf("maxLen 必须大于0")
+	}
+	value, err := encodeValue(v)
+	if err != nil {
+		return err
+	}
+	conn, err := p.getConn(db)
+	if err != nil {
 		return err
 	}
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("LPUSH", key, value)
+	conn.Send("LTRIM", key, 0, maxLen-1)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// 列表元素编码：string原样保存，其他类型编码为json
+func encodeValue(v interface{}) (string, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
 }
 
 func (p *Redis) BRPOP(db int, key string, timeout int) (string, error) {
@@ -126,12 +628,84 @@ func (p *Redis) BRPOP(db int, key string, timeout int) (string, error) {
 	return "", err
 }
 
+// 阻塞等待多个列表，返回有数据的key和弹出的值；超时返回空字符串且无错误
+func (p *Redis) BRPopMulti(db int, keys []string, timeout int) (key, value string, err error) {
+	if len(keys) == 0 {
+		return "", "", fmt.Errorf("keys 不允许为空")
+	}
+	args := make([]interface{}, 0, len(keys)+1)
+	for _, k := range keys {
+		args = append(args, k)
+	}
+	args = append(args, timeout)
+
+	arr, err := redis.Strings(p.Do(db, "BRPOP", args...))
+	if err == redis.ErrNil {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if len(arr) != 2 {
+		return "", "", fmt.Errorf("BRPOP 返回格式错误: %v", arr)
+	}
+	return arr[0], arr[1], nil
+}
+
+// BRPOP弹出并将值按JSON解码到out，与LPUSH对非string值的编码对应；超时返回found为false
+func (p *Redis) BRPopInto(db int, key string, timeout int, out interface{}) (found bool, err error) {
+	arr, err := redis.ByteSlices(p.Do(db, "BRPOP", key, timeout))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(arr) != 2 {
+		return false, fmt.Errorf("BRPOP 返回格式错误: %q", arr)
+	}
+	if err := json.Unmarshal(arr[1], out); err != nil {
+		return true, fmt.Errorf("解码 %s 弹出的值失败: %v", key, err)
+	}
+	return true, nil
+}
+
+// 阻塞从多个列表中弹出最多count个元素(BLMPOP，Redis 7+)，direction为"LEFT"或"RIGHT"
+// 超时返回空key、nil切片且无错误
+func (p *Redis) BLMPop(db int, timeout int, keys []string, direction string, count int) (key string, values []string, err error) {
+	if len(keys) == 0 {
+		return "", nil, fmt.Errorf("keys 不允许为空")
+	}
+	args := redis.Args{}.Add(timeout, len(keys)).AddFlat(keys).Add(direction, "COUNT", count)
+	reply, err := redis.Values(p.Do(db, "BLMPOP", args...))
+	if err == redis.ErrNil {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if len(reply) != 2 {
+		return "", nil, fmt.Errorf("BLMPOP 返回格式错误: %v", reply)
+	}
+	if key, err = redis.String(reply[0], nil); err != nil {
+		return "", nil, err
+	}
+	values, err = redis.Strings(reply[1], nil)
+	return key, values, err
+}
+
 func (p *Redis) LLEN(db int, key string) (int64, error) {
+	if err := p.checkType(db, key, "list"); err != nil {
+		return 0, err
+	}
 	result, err := redis.Int64(p.Do(db, "LLEN", key))
 	return result, err
 }
 
 func (p *Redis) LRANGE(db int, key string, start, end int64) ([]string, error) {
+	if err := p.checkType(db, key, "list"); err != nil {
+		return nil, err
+	}
 	return redis.Strings(p.Do(db, "LRANGE", key, start, end))
 }
 
@@ -139,6 +713,24 @@ func (p *Redis) LPOP(db int, key string) (string, error) {
 	return redis.String(p.Do(db, "LPOP", key))
 }
 
+// 从列表头部弹出最多count个元素(Redis 6.2+)，列表不足count个时返回全部，不存在返回空
+func (p *Redis) LPopN(db int, key string, count int) ([]string, error) {
+	return popN(p.Do(db, "LPOP", key, count))
+}
+
+// 从列表尾部弹出最多count个元素(Redis 6.2+)，列表不足count个时返回全部，不存在返回空
+func (p *Redis) RPopN(db int, key string, count int) ([]string, error) {
+	return popN(p.Do(db, "RPOP", key, count))
+}
+
+func popN(reply interface{}, err error) ([]string, error) {
+	values, err := redis.Strings(reply, err)
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return values, err
+}
+
 func (p *Redis) LSET(db int, key string, index int64, v interface{}) error {
 	bytes, _ := json.Marshal(v)
 	_, err := p.Do(db, "LSET", key, index, string(bytes))
@@ -146,15 +738,74 @@ func (p *Redis) LSET(db int, key string, index int64, v interface{}) error {
 }
 
 func (p *Redis) LINDEX(db int, key string, index int64) (string, error) {
+	if err := p.checkType(db, key, "list"); err != nil {
+		return "", err
+	}
 	return redis.String(p.Do(db, "LINDEX", key, index))
 }
 
+func (p *Redis) SMEMBERS(db int, key string) ([]string, error) {
+	if err := p.checkType(db, key, "set"); err != nil {
+		return nil, err
+	}
+	return redis.Strings(p.Do(db, "SMEMBERS", key))
+}
+
 // 设置过期
 func (p *Redis) SetExpire(db int, key string, sec int) error {
 	_, err := p.Do(0, "EXPIRE", key, sec)
 	return err
 }
 
+// 设置过期，毫秒精度
+func (p *Redis) PExpire(db int, key string, ttl time.Duration) error {
+	_, err := p.Do(db, "PEXPIRE", key, toMillis(ttl))
+	return err
+}
+
+// 获取剩余过期时间，毫秒精度；key不存在返回-2，未设置过期返回-1
+func (p *Redis) PTTL(db int, key string) (time.Duration, error) {
+	ms, err := redis.Int64(p.Do(db, "PTTL", key))
+	if err != nil {
+		return 0, err
+	}
+	if ms < 0 {
+		return time.Duration(ms), nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// 获取过期的时间点(PEXPIRETIME，Redis 7+)，毫秒精度
+// 未设置过期返回零值time.Time，key不存在返回redis.ErrNil
+func (p *Redis) PExpireTime(db int, key string) (time.Time, error) {
+	ms, err := redis.Int64(p.Do(db, "PEXPIRETIME", key))
+	if err != nil {
+		return time.Time{}, err
+	}
+	switch ms {
+	case -2:
+		return time.Time{}, redis.ErrNil
+	case -1:
+		return time.Time{}, nil
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)), nil
+}
+
+// 设置值并指定过期时间，毫秒精度
+func (p *Redis) SetWithTTL(db int, key string, value interface{}, ttl time.Duration) error {
+	_, err := p.Do(db, "SET", key, value, "PX", toMillis(ttl))
+	return err
+}
+
+// 转换为毫秒，不足1毫秒的正数按1毫秒处理，避免被当作0立即过期
+func toMillis(d time.Duration) int64 {
+	ms := int64(d / time.Millisecond)
+	if ms == 0 && d > 0 {
+		return 1
+	}
+	return ms
+}
+
 // 正则匹配keys
 func (p *Redis) RegularKeys(db int, key string) ([]string, error) {
 	return redis.Strings(p.Do(db, "KEYS", key))
@@ -166,6 +817,10 @@ func (p *Redis) DelRegularKeys(db int, key string) error {
 		return err
 	}
 	for _, item := range items {
+		if p.DryRun {
+			p.logf("redis dry-run: DEL db=%d key=%s", db, item)
+			continue
+		}
 		if _, err := p.Do(db, "DEL", item); err != nil {
 			return err
 		}
@@ -176,7 +831,7 @@ func (p *Redis) DelRegularKeys(db int, key string) error {
 func (p *Redis) ZADD(db int, key string, values map[string]interface{}) error {
 	args := []interface{}{key}
 	for member, score := range values {
-		args = append(args, score, member)
+		args = append(args, formatScore(score), member)
 	}
 	if len(args) == 1 {
 		return fmt.Errorf("values 不允许为空")
@@ -186,6 +841,294 @@ func (p *Redis) ZADD(db int, key string, values map[string]interface{}) error {
 	return err
 }
 
+// 有序集合成员及分值
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+// 解析WITHSCORES返回的 member, score 交替列表
+func parseZMembers(pairs []string) ([]ZMember, error) {
+	if len(pairs)%2 != 0 {
+		return nil, fmt.Errorf("WITHSCORES 返回格式错误: %v", pairs)
+	}
+	members := make([]ZMember, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		score, err := strconv.ParseFloat(pairs[i+1], 64)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, ZMember{Member: pairs[i], Score: score})
+	}
+	return members, nil
+}
+
+// 阻塞从多个有序集合中弹出最多count个成员(BZMPOP，Redis 7+)，order为"MIN"或"MAX"
+// 超时返回空key、nil切片且无错误
+func (p *Redis) BZMPop(db int, timeout int, keys []string, order string, count int) (key string, members []ZMember, err error) {
+	if len(keys) == 0 {
+		return "", nil, fmt.Errorf("keys 不允许为空")
+	}
+	args := redis.Args{}.Add(timeout, len(keys)).AddFlat(keys).Add(order, "COUNT", count)
+	reply, err := redis.Values(p.Do(db, "BZMPOP", args...))
+	if err == redis.ErrNil {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if len(reply) != 2 {
+		return "", nil, fmt.Errorf("BZMPOP 返回格式错误: %v", reply)
+	}
+	if key, err = redis.String(reply[0], nil); err != nil {
+		return "", nil, err
+	}
+	items, err := redis.Values(reply[1], nil)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, item := range items {
+		pair, err := redis.Strings(item, nil)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(pair) != 2 {
+			return "", nil, fmt.Errorf("BZMPOP 返回格式错误: %v", pair)
+		}
+		score, err := strconv.ParseFloat(pair[1], 64)
+		if err != nil {
+			return "", nil, err
+		}
+		members = append(members, ZMember{Member: pair[0], Score: score})
+	}
+	return key, members, nil
+}
+
+// 获取成员分值，成员不存在返回redis.ErrNil
+func (p *Redis) ZSCORE(db int, key, member string) (float64, error) {
+	s, err := redis.String(p.Do(db, "ZSCORE", key, member))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// 批量获取成员分值(ZMSCORE，Redis 6.2+)，found中对应位置为false表示成员不存在
+func (p *Redis) ZMScore(db int, key string, members ...string) ([]float64, []bool, error) {
+	if len(members) == 0 {
+		return nil, nil, nil
+	}
+	replies, err := redis.Values(p.Do(db, "ZMSCORE", redis.Args{}.Add(key).AddFlat(members)...))
+	if err != nil {
+		return nil, nil, err
+	}
+	scores := make([]float64, len(replies))
+	found := make([]bool, len(replies))
+	for i, reply := range replies {
+		if reply == nil {
+			continue
+		}
+		s, err := redis.String(reply, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if scores[i], err = strconv.ParseFloat(s, 64); err != nil {
+			return nil, nil, err
+		}
+		found[i] = true
+	}
+	return scores, found, nil
+}
+
+// 浮点分值使用完整精度的十进制格式，避免时间戳等大数值分值丢失精度
+func formatScore(score interface{}) interface{} {
+	switch v := score.(type) {
+	case float64:
+		return scoreString(v)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	}
+	return score
+}
+
+func scoreString(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "+inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
+
+// 按(分值,成员)游标分页，返回在(afterScore, afterMember)之后的最多pageSize个成员
+// 第一页传 math.Inf(-1) 和 ""，之后传上一页最后一个成员的Score和Member；集合被修改时也不会重复或遗漏
+func (p *Redis) ZPageByScore(db int, key string, afterScore float64, afterMember string, pageSize int) ([]ZMember, error) {
+	if pageSize <= 0 {
+		return nil, fmt.Errorf("pageSize 必须大于0")
+	}
+	conn, err := p.getConn(db)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return zPageAfter(conn, key, scoreString(afterScore), afterMember, "+inf", pageSize)
+}
+
+// 分页读取[min, max]范围内的成员并逐个发送到返回的channel，读取完毕或ctx取消后关闭channel
+// 分页使用(分值,成员)游标，每次最多从服务端读取pageSize个成员，大量成员分值相同时也是如此
+// 出错时错误发送到错误channel
+func (p *Redis) ZRangeByScoreChan(ctx context.Context, db int, key string, min, max string, pageSize int) (<-chan ZMember, <-chan error) {
+	errc := make(chan error, 1)
+	if pageSize <= 0 {
+		members := make(chan ZMember)
+		close(members)
+		errc <- fmt.Errorf("pageSize 必须大于0")
+		close(errc)
+		return members, errc
+	}
+
+	members := make(chan ZMember, pageSize)
+	go func() {
+		defer close(members)
+		defer close(errc)
+
+		var last *ZMember
+		for {
+			page, err := p.zRangePage(db, key, min, max, last, pageSize)
+			if err != nil {
+				errc <- err
+				return
+			}
+			for _, m := range page {
+				select {
+				case members <- m:
+				case <-ctx.Done():
+					errc <- ctx.Err()
+					return
+				}
+			}
+			if len(page) < pageSize {
+				return
+			}
+			last = &page[len(page)-1]
+		}
+	}()
+	return members, errc
+}
+
+// last为空时读取第一页，否则读取last之后的一页
+func (p *Redis) zRangePage(db int, key, min, max string, last *ZMember, pageSize int) ([]ZMember, error) {
+	conn, err := p.getConn(db)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if last != nil {
+		return zPageAfter(conn, key, scoreString(last.Score), last.Member, max, pageSize)
+	}
+	pairs, err := redis.Strings(conn.Do("ZRANGEBYSCORE", key, min, max, "WITHSCORES", "LIMIT", 0, pageSize))
+	if err != nil {
+		return nil, err
+	}
+	return parseZMembers(pairs)
+}
+
+// 取分值等于score且成员大于member的成员，不足pageSize时再取分值在(score, max]内的成员
+// member仍以该分值存在时按排名直接取后续成员；否则分批读取同分值的成员，每次最多pageSize个
+func zPageAfter(conn redis.Conn, key, score, member, max string, pageSize int) ([]ZMember, error) {
+	page, ok, err := zPageAfterRank(conn, key, score, member, max, pageSize)
+	if err != nil || ok {
+		return page, err
+	}
+
+	// 分值相同的成员按字节序排列，与Go的字符串比较一致
+	page = make([]ZMember, 0, pageSize)
+	for offset := 0; ; offset += pageSize {
+		pairs, err := redis.Strings(conn.Do("ZRANGEBYSCORE", key, score, score, "WITHSCORES", "LIMIT", offset, pageSize))
+		if err != nil {
+			return nil, err
+		}
+		ties, err := parseZMembers(pairs)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range ties {
+			if m.Member > member {
+				page = append(page, m)
+				if len(page) == pageSize {
+					return page, nil
+				}
+			}
+		}
+		if len(ties) < pageSize {
+			break
+		}
+	}
+
+	pairs, err := redis.Strings(conn.Do("ZRANGEBYSCORE", key, "("+score, max, "WITHSCORES", "LIMIT", 0, pageSize-len(page)))
+	if err != nil {
+		return nil, err
+	}
+	rest, err := parseZMembers(pairs)
+	if err != nil {
+		return nil, err
+	}
+	return append(page, rest...), nil
+}
+
+// member仍以score存在时，由其排名取之后最多pageSize个不超过max的成员；ok为false表示需要按分值查找
+func zPageAfterRank(conn redis.Conn, key, score, member, max string, pageSize int) (page []ZMember, ok bool, err error) {
+	conn.Send("ZSCORE", key, member)
+	conn.Send("ZRANK", key, member)
+	if err := conn.Flush(); err != nil {
+		return nil, false, err
+	}
+	current, scoreErr := redis.Float64(conn.Receive())
+	rank, err := redis.Int64(conn.Receive())
+	if scoreErr == redis.ErrNil || err == redis.ErrNil {
+		return nil, false, nil
+	}
+	if scoreErr != nil {
+		return nil, false, scoreErr
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	expected, err := strconv.ParseFloat(score, 64)
+	if err != nil || current != expected {
+		return nil, false, nil
+	}
+
+	pairs, err := redis.Strings(conn.Do("ZRANGE", key, rank+1, rank+int64(pageSize), "WITHSCORES"))
+	if err != nil {
+		return nil, false, err
+	}
+	members, err := parseZMembers(pairs)
+	if err != nil {
+		return nil, false, err
+	}
+	for i, m := range members {
+		if !scoreBelowMax(m.Score, max) {
+			return members[:i], true, nil
+		}
+	}
+	return members, true, nil
+}
+
+// score是否在ZRANGEBYSCORE的上限max之内，max可以是"(5"这样的开区间
+func scoreBelowMax(score float64, max string) bool {
+	exclusive := strings.HasPrefix(max, "(")
+	limit, err := strconv.ParseFloat(strings.TrimPrefix(max, "("), 64)
+	if err != nil {
+		return true
+	}
+	if exclusive {
+		return score < limit
+	}
+	return score <= limit
+}
+
 func (p *Redis) ZCARD(db int, key string) (int64, error) {
 	result, err := redis.Int64(p.Do(db, "ZCARD", key))
 	return result, err
@@ -200,6 +1143,26 @@ func (p *Redis) ZRANGEBYSCORE(db int, key string, min, max int64) ([]string, err
 	return redis.Strings(p.Do(db, "ZRANGEBYSCORE", key, min, max))
 }
 
+// 将时间转换为TimeScorePrecision单位的分数
+func (p *Redis) timeScore(t time.Time) int64 {
+	precision := p.config.TimeScorePrecision
+	if precision <= 0 {
+		precision = time.Millisecond
+	}
+	return t.UnixNano() / int64(precision)
+}
+
+// 以时间作为分数加入zset，分数单位由Config.TimeScorePrecision决定
+func (p *Redis) ZAddTime(db int, key, member string, t time.Time) error {
+	_, err := p.Do(db, "ZADD", key, p.timeScore(t), member)
+	return err
+}
+
+// 返回时间在[from, to]之间的成员，按时间升序
+func (p *Redis) ZRangeByTime(db int, key string, from, to time.Time) ([]string, error) {
+	return p.ZRANGEBYSCORE(db, key, p.timeScore(from), p.timeScore(to))
+}
+
 func (p *Redis) ZREMRANGEBYSCORE(db int, key string, min, max int64) (int64, error) {
 	result, err := redis.Int64(p.Do(db, "ZREMRANGEBYSCORE", key, min, max))
 	return result, err
@@ -210,12 +1173,177 @@ func (p *Redis) ZREMRANGEBYRANK(db int, key string, min, max int64) (int64, erro
 	return result, err
 }
 
+// 统计区间内为1的位数，unit为"BYTE"或"BIT"（Redis 7+），为空时按字节
+func (p *Redis) BitCount(db int, key string, start, end int64, unit string) (int64, error) {
+	args := []interface{}{key, start, end}
+	switch strings.ToUpper(unit) {
+	case "":
+	case "BYTE", "BIT":
+		args = append(args, strings.ToUpper(unit))
+	default:
+		return 0, fmt.Errorf("unit 只能为 BYTE 或 BIT: %s", unit)
+	}
+	return redis.Int64(p.Do(db, "BITCOUNT", args...))
+}
+
+// 管道中逐个PFCOUNT，返回每个HyperLogLog的基数估计
+func (p *Redis) PFCountEach(db int, keys ...string) (map[string]int64, error) {
+	result := make(map[string]int64, len(keys))
+	if len(keys) == 0 {
+		return result, nil
+	}
+	conn, err := p.getConn(db)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	for _, key := range keys {
+		conn.Send("PFCOUNT", key)
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	var firstErr error
+	for _, key := range keys {
+		n, err := redis.Int64(conn.Receive())
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		result[key] = n
+	}
+	return result, firstErr
+}
+
 func (p *Redis) DELKey(db int, key string) error {
+	if p.DryRun {
+		p.logf("redis dry-run: DEL db=%d key=%s", db, key)
+		return nil
+	}
 	_, err := p.Do(db, "DEL", key)
 	return err
 }
 
+// 逐个删除keys（管道执行），返回每个key删除前是否存在
+func (p *Redis) DelEach(db int, keys ...string) (map[string]bool, error) {
+	result := make(map[string]bool, len(keys))
+	if len(keys) == 0 {
+		return result, nil
+	}
+	conn, err := p.getConn(db)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// DryRun时使用EXISTS得到同样的结果而不删除
+	command := "DEL"
+	if p.DryRun {
+		command = "EXISTS"
+	}
+	for _, key := range keys {
+		conn.Send(command, key)
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	var firstErr error
+	for _, key := range keys {
+		n, err := redis.Int64(conn.Receive())
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		result[key] = n > 0
+		if p.DryRun && n > 0 {
+			p.logf("redis dry-run: DEL db=%d key=%s", db, key)
+		}
+	}
+	return result, firstErr
+}
+
+// 将临时key原子替换为正式key并设置过期，读者不会看到没有过期时间的正式key
+// ttl<=0时正式key不过期(清除临时key上的过期时间)
+func (p *Redis) PromoteKey(db int, tmp, final string, ttl time.Duration) error {
+	conn, err := p.getConn(db)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// WATCH临时key，防止检查存在后到EXEC之间被修改
+	if _, err := conn.Do("WATCH", tmp); err != nil {
+		return err
+	}
+	exist, err := redis.Bool(conn.Do("EXISTS", tmp))
+	if err != nil || !exist {
+		conn.Do("UNWATCH")
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("key %s 不存在", tmp)
+	}
+
+	conn.Send("MULTI")
+	conn.Send("RENAME", tmp, final)
+	if ttl > 0 {
+		conn.Send("PEXPIRE", final, toMillis(ttl))
+	} else {
+		conn.Send("PERSIST", final)
+	}
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err == redis.ErrNil {
+		return fmt.Errorf("key %s 在替换过程中被修改", tmp)
+	}
+	if err != nil {
+		return err
+	}
+	for _, reply := range replies {
+		if e, ok := reply.(redis.Error); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// 抢占幂等key(SET NX，ttl后过期)，返回是否抢到；key已被其他请求抢占时返回false
+func (p *Redis) ClaimIdempotencyKey(db int, key string, ttl time.Duration) (claimed bool, err error) {
+	_, err = redis.String(p.Do(db, "SET", key, 1, "NX", "PX", toMillis(ttl)))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// 多实例间只执行一次：抢到标记key(SET NX，ttl过期)的实例执行fn，返回是否执行
+// fn返回错误时会删除标记，允许之后重新执行
+func (p *Redis) DoOnce(db int, key string, ttl time.Duration, fn func() error) (ran bool, err error) {
+	claimed, err := p.ClaimIdempotencyKey(db, key, ttl)
+	if err != nil || !claimed {
+		return false, err
+	}
+	if err := fn(); err != nil {
+		p.Do(db, "DEL", key)
+		return true, err
+	}
+	return true, nil
+}
+
 func (p *Redis) PUBLISH(db int, channel, msg string) error {
 	_, err := p.Do(db, "PUBLISH", channel, msg)
 	return err
 }
+
+// 解析INFO等命令返回的 "key:value" 行
+func parseInfo(info string) map[string]string {
+	result := make(map[string]string)
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.Index(line, ":"); i > 0 {
+			result[line[:i]] = line[i+1:]
+		}
+	}
+	return result
+}
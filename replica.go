@@ -0,0 +1,80 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 读写一致性等待从库同步的最长时间
+const replicaSyncTimeout = time.Second
+
+// 初始化从库连接池，之后可通过ReplicaDo将读请求发往从库；连接钩子等其余配置沿用主库
+// 从库连接额外执行Config.ReplicaOnBorrow中的命令
+func (p *Redis) InitReplica(host string, port int, password string, maxConn, maxIdle int) error {
+	cfg := p.config
+	cfg.Host, cfg.Port, cfg.Password = host, port, password
+	cfg.MaxConn, cfg.MaxIdle = maxConn, maxIdle
+	cfg.SentinelAddrs = nil // 从库使用指定的地址，不通过Sentinel查询主节点
+	p.replica = p.newPool(cfg)
+	if p.replica == nil {
+		return errors.New("redis从库初始化失败！")
+	}
+	return nil
+}
+
+// 在从库执行命令，未初始化从库时使用主库
+func (p *Redis) ReplicaDo(db int, command string, args ...interface{}) (interface{}, error) {
+	if p.replica == nil {
+		return p.Do(db, command, args...)
+	}
+	conn, err := p.borrow(p.replica, db)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.Do(command, args...)
+}
+
+// 先执行写操作，等待从库追上主库的复制偏移量后再执行读操作，保证读到自己的写入
+// readFn中应使用ReplicaDo读取
+// 注：WAIT只对同一连接上的写入生效，而writeFn使用的是连接池中的其他连接，所以这里比较复制偏移量
+func (p *Redis) ReadAfterWrite(db int, writeFn func() error, readFn func() (interface{}, error)) (interface{}, error) {
+	if err := writeFn(); err != nil {
+		return nil, err
+	}
+	if p.replica == nil {
+		return readFn()
+	}
+
+	info, err := redis.String(p.Do(db, "INFO", "replication"))
+	if err != nil {
+		return nil, err
+	}
+	target, err := strconv.ParseInt(parseInfo(info)["master_repl_offset"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("无法获取主库复制偏移量: %v", err)
+	}
+
+	deadline := time.Now().Add(replicaSyncTimeout)
+	for {
+		info, err := redis.String(p.ReplicaDo(db, "INFO", "replication"))
+		if err != nil {
+			return nil, err
+		}
+		offset, err := strconv.ParseInt(parseInfo(info)["slave_repl_offset"], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("无法获取从库复制偏移量: %v", err)
+		}
+		if offset >= target {
+			return readFn()
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("等待从库同步超时")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
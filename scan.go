@@ -0,0 +1,607 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 每次SCAN建议返回的数量
+const scanCount = 100
+
+// 在scanKeys的fn中返回，提前结束遍历
+var errStopScan = errors.New("stop scan")
+
+// 使用SCAN遍历当前db中匹配的keys，每批调用一次fn
+// conn需已切换到目标db，fn中可以继续使用同一个conn执行命令
+func scanKeys(conn redis.Conn, match string, fn func(keys []string) error) error {
+	return scanKeysOfType(conn, match, "", fn)
+}
+
+// 同scanKeys，typ不为空时只返回该类型的keys（SCAN TYPE，Redis 6+）
+func scanKeysOfType(conn redis.Conn, match, typ string, fn func(keys []string) error) error {
+	cursor := 0
+	for {
+		args := redis.Args{}.Add(cursor, "MATCH", match, "COUNT", scanCount)
+		if typ != "" {
+			args = args.Add("TYPE", typ)
+		}
+		values, err := redis.Values(conn.Do("SCAN", args...))
+		if err != nil {
+			return err
+		}
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := fn(keys); err == errStopScan {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// 将srcDB中匹配的keys移动到destDB，返回移动的数量
+// 目标库已存在同名key时，skipExisting为true则跳过，否则返回错误
+func (p *Redis) MoveMatching(srcDB int, match string, destDB int, skipExisting bool) (int64, error) {
+	if srcDB == destDB {
+		return 0, fmt.Errorf("源库和目标库不能相同")
+	}
+	conn, err := p.getConn(srcDB)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	var moved int64
+	err = scanKeys(conn, match, func(keys []string) error {
+		for _, key := range keys {
+			ok, err := redis.Bool(conn.Do("MOVE", key, destDB))
+			if err != nil {
+				return err
+			}
+			if ok {
+				moved++
+				continue
+			}
+			// MOVE返回0：目标库已存在，或key在扫描后已被删除/过期
+			exist, err := redis.Bool(conn.Do("EXISTS", key))
+			if err != nil {
+				return err
+			}
+			if exist && !skipExisting {
+				return fmt.Errorf("key %s 在目标库 %d 中已存在", key, destDB)
+			}
+		}
+		return nil
+	})
+	return moved, err
+}
+
+// 删除匹配的keys中空闲时间(OBJECT IDLETIME)超过idleThreshold的，最多删除max个(max<=0不限制)
+// 返回删除的数量
+func (p *Redis) EvictIdleKeys(db int, match string, idleThreshold time.Duration, max int) (int64, error) {
+	conn, err := p.getConn(db)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	threshold := int64(idleThreshold / time.Second)
+	var deleted int64
+	err = scanKeys(conn, match, func(keys []string) error {
+		for _, key := range keys {
+			conn.Send("OBJECT", "IDLETIME", key)
+		}
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+		// 读完所有回复后再返回错误，避免连接中残留未读的回复
+		var idle []string
+		var firstErr error
+		for _, key := range keys {
+			sec, err := redis.Int64(conn.Receive())
+			if err == redis.ErrNil {
+				continue // key已被删除
+			}
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			if sec > threshold {
+				idle = append(idle, key)
+			}
+		}
+		if firstErr != nil {
+			return firstErr
+		}
+
+		for _, key := range idle {
+			if max > 0 && deleted >= int64(max) {
+				return errStopScan
+			}
+			if p.DryRun {
+				p.logf("redis dry-run: DEL db=%d key=%s idle>%v", db, key, idleThreshold)
+				deleted++
+				continue
+			}
+			n, err := redis.Int64(conn.Do("DEL", key))
+			if err != nil {
+				return err
+			}
+			deleted += n
+		}
+		if max > 0 && deleted >= int64(max) {
+			return errStopScan
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// 并发修改时ScanTransform对单个key的最大重试次数
+const transformRetries = 3
+
+// 遍历匹配的string类型keys，用transform转换值后写回并保留原过期时间，返回转换的数量
+// 每个key使用WATCH保证读改写期间没有被其他客户端修改，冲突时重试
+func (p *Redis) ScanTransform(db int, match string, transform func(key, oldValue string) (newValue string, err error)) (int64, error) {
+	conn, err := p.getConn(db)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	var transformed int64
+	err = scanKeysOfType(conn, match, "string", func(keys []string) error {
+		for _, key := range keys {
+			ok, err := transformKey(conn, key, transform)
+			if err != nil {
+				return err
+			}
+			if ok {
+				transformed++
+			}
+		}
+		return nil
+	})
+	return transformed, err
+}
+
+func transformKey(conn redis.Conn, key string, transform func(key, oldValue string) (string, error)) (bool, error) {
+	for i := 0; i < transformRetries; i++ {
+		if _, err := conn.Do("WATCH", key); err != nil {
+			return false, err
+		}
+		old, err := redis.String(conn.Do("GET", key))
+		if err != nil {
+			conn.Do("UNWATCH")
+			if err == redis.ErrNil {
+				return false, nil // 扫描后已被删除
+			}
+			return false, err
+		}
+		value, err := transform(key, old)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return false, err
+		}
+
+		conn.Send("MULTI")
+		conn.Send("SET", key, value, "KEEPTTL")
+		if _, err := redis.Values(conn.Do("EXEC")); err == nil {
+			return true, nil
+		} else if err != redis.ErrNil {
+			return false, err
+		}
+	}
+	return false, fmt.Errorf("key %s 并发修改，转换失败", key)
+}
+
+// 使用SSCAN遍历集合成员，每批调用一次fn
+func sscanMembers(conn redis.Conn, key string, fn func(members []string) error) error {
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SSCAN", key, cursor, "COUNT", scanCount))
+		if err != nil {
+			return err
+		}
+		var members []string
+		if _, err := redis.Scan(values, &cursor, &members); err != nil {
+			return err
+		}
+		if len(members) > 0 {
+			if err := fn(members); err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// 找出索引集合中对应key已不存在的成员，keyFn由成员得到对应的key
+func (p *Redis) FindOrphans(db int, indexSet string, keyFn func(member string) string) ([]string, error) {
+	conn, err := p.getConn(db)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var orphans []string
+	seen := make(map[string]struct{})
+	err = sscanMembers(conn, indexSet, func(batch []string) error {
+		// SSCAN可能重复返回同一个成员
+		members := make([]string, 0, len(batch))
+		for _, member := range batch {
+			if _, ok := seen[member]; !ok {
+				seen[member] = struct{}{}
+				members = append(members, member)
+			}
+		}
+		for _, member := range members {
+			conn.Send("EXISTS", keyFn(member))
+		}
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+		var firstErr error
+		for _, member := range members {
+			exist, err := redis.Bool(conn.Receive())
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			if !exist {
+				orphans = append(orphans, member)
+			}
+		}
+		return firstErr
+	})
+	return orphans, err
+}
+
+// 按前缀统计keys数量：取key中最多depth段、且不含最后一段(通常为ID)的前缀作为分组
+// 例如separator为":"、depth为2时，"cache:user:1"计入"cache:user"，"session:abc"计入"session"；没有分隔符的key单独计数
+func (p *Redis) KeyPrefixHistogram(db int, separator string, depth int) (map[string]int64, error) {
+	if separator == "" || depth <= 0 {
+		return nil, fmt.Errorf("separator 不允许为空且 depth 必须大于0")
+	}
+	conn, err := p.getConn(db)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	histogram := make(map[string]int64)
+	err = scanKeys(conn, "*", func(keys []string) error {
+		for _, key := range keys {
+			histogram[keyPrefix(key, separator, depth)]++
+		}
+		return nil
+	})
+	return histogram, err
+}
+
+func keyPrefix(key, separator string, depth int) string {
+	parts := strings.SplitN(key, separator, depth+1)
+	n := len(parts) - 1
+	if n == 0 {
+		return key
+	}
+	if n > depth {
+		n = depth
+	}
+	return strings.Join(parts[:n], separator)
+}
+
+// 一个goroutine负责SCAN，workers个goroutine并发对每个key调用fn
+// 任意一次fn返回错误后停止扫描和分发，返回第一个错误
+func (p *Redis) ScanParallel(db int, match string, workers int, fn func(key string) error) error {
+	if workers <= 0 {
+		return fmt.Errorf("workers 必须大于0")
+	}
+	conn, err := p.getConn(db)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var (
+		once     sync.Once
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	stop := make(chan struct{})
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			close(stop)
+		})
+	}
+
+	queue := make(chan string, workers*2)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range queue {
+				select {
+				case <-stop:
+					continue
+				default:
+				}
+				if err := fn(key); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	scanErr := scanKeys(conn, match, func(keys []string) error {
+		for _, key := range keys {
+			select {
+			case queue <- key:
+			case <-stop:
+				return errStopScan
+			}
+		}
+		return nil
+	})
+	close(queue)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return scanErr
+}
+
+// 转义glob元字符，使字符串在MATCH/PSUBSCRIBE中按字面匹配；按字节处理，二进制key也安全
+func escapeGlob(s string) string {
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '[', ']', '\\':
+			buf = append(buf, '\\')
+		}
+		buf = append(buf, s[i])
+	}
+	return string(buf)
+}
+
+// 将所有以oldPrefix开头的key重命名为newPrefix开头，返回重命名的数量
+// 目标key已存在时overwrite为true则覆盖，否则跳过该key
+func (p *Redis) RenamePrefix(db int, oldPrefix, newPrefix string, overwrite bool) (int64, error) {
+	if oldPrefix == "" || oldPrefix == newPrefix {
+		return 0, fmt.Errorf("oldPrefix 不允许为空且不能与 newPrefix 相同")
+	}
+	conn, err := p.getConn(db)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	var renamed int64
+	rename := func(keys []string) error {
+		for _, key := range keys {
+			command := "RENAMENX"
+			if overwrite {
+				command = "RENAME"
+			}
+			reply, err := conn.Do(command, key, renameTarget(key, oldPrefix, newPrefix))
+			if isNoSuchKey(err) {
+				continue // SCAN可能重复返回已重命名的key，或key已被删除
+			}
+			if err != nil {
+				return err
+			}
+			if ok, _ := redis.Bool(reply, nil); ok || overwrite {
+				renamed++
+			}
+		}
+		return nil
+	}
+
+	match := escapeGlob(oldPrefix) + "*"
+	// 一个前缀是另一个的前缀时，重命名后的key仍会被SCAN扫到，需要先收集全部key再按顺序重命名
+	if renameRematches(oldPrefix, newPrefix) {
+		var keys []string
+		err = scanKeys(conn, match, func(batch []string) error {
+			keys = append(keys, batch...)
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		err = rename(renameOrder(keys, oldPrefix, newPrefix))
+		return renamed, err
+	}
+	err = scanKeys(conn, match, rename)
+	return renamed, err
+}
+
+// key重命名后的名字，key需以oldPrefix开头
+func renameTarget(key, oldPrefix, newPrefix string) string {
+	return newPrefix + key[len(oldPrefix):]
+}
+
+// 重命名后的key是否仍以oldPrefix开头，即可能被SCAN再次扫到或与待重命名的key冲突
+func renameRematches(oldPrefix, newPrefix string) bool {
+	return strings.HasPrefix(newPrefix, oldPrefix) || strings.HasPrefix(oldPrefix, newPrefix)
+}
+
+// 去重并排序收集到的keys，保证目标key本身也待重命名时先重命名目标key
+// 新前缀更长时目标比源长，先处理长的；新前缀更短时先处理短的；长度单调变化，不会成环
+func renameOrder(keys []string, oldPrefix, newPrefix string) []string {
+	seen := make(map[string]struct{}, len(keys))
+	ordered := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			ordered = append(ordered, key)
+		}
+	}
+	longerFirst := len(newPrefix) > len(oldPrefix)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if longerFirst {
+			return len(ordered[i]) > len(ordered[j])
+		}
+		return len(ordered[i]) < len(ordered[j])
+	})
+	return ordered
+}
+
+func isNoSuchKey(err error) bool {
+	e, ok := err.(redis.Error)
+	return ok && strings.Contains(string(e), "no such key")
+}
+
+// 重新分片前的分析：扫描匹配的keys，返回shardFn计算的目标分片不是currentShard、需要迁出的keys
+// 只做分析不移动数据，实际迁移由调用方完成
+func (p *Redis) Rebalance(db int, match string, shardFn func(key string) int, currentShard int) ([]string, error) {
+	conn, err := p.getConn(db)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var moves []string
+	err = scanKeys(conn, match, func(keys []string) error {
+		for _, key := range keys {
+			if shardFn(key) != currentShard {
+				moves = append(moves, key)
+			}
+		}
+		return nil
+	})
+	return moves, err
+}
+
+// SampleKeys最多执行sampleSize*sampleAttempts次RANDOMKEY，keys较少时重复率高，避免一直循环
+const sampleAttempts = 3
+
+// 用RANDOMKEY随机抽取最多sampleSize个不重复的key，用于快速估算类型分布、平均大小等
+// 结果是近似的：RANDOMKEY不保证均匀分布，keys总数少于sampleSize或重复较多时返回的数量会不足
+func (p *Redis) SampleKeys(db int, sampleSize int) ([]string, error) {
+	if sampleSize <= 0 {
+		return nil, nil
+	}
+	conn, err := p.getConn(db)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	seen := make(map[string]struct{}, sampleSize)
+	keys := make([]string, 0, sampleSize)
+	for attempts := sampleSize * sampleAttempts; attempts > 0 && len(keys) < sampleSize; {
+		batch := sampleSize - len(keys)
+		if batch > scanCount {
+			batch = scanCount
+		}
+		if batch > attempts {
+			batch = attempts
+		}
+		attempts -= batch
+		for i := 0; i < batch; i++ {
+			conn.Send("RANDOMKEY")
+		}
+		if err := conn.Flush(); err != nil {
+			return keys, err
+		}
+		var firstErr error
+		empty := false
+		for i := 0; i < batch; i++ {
+			key, err := redis.String(conn.Receive())
+			if err == redis.ErrNil {
+				empty = true
+				continue
+			}
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			if _, ok := seen[key]; !ok && len(keys) < sampleSize {
+				seen[key] = struct{}{}
+				keys = append(keys, key)
+			}
+		}
+		if firstErr != nil || empty {
+			return keys, firstErr
+		}
+	}
+	return keys, nil
+}
+
+// 扫描匹配的string类型keys，按值分组，返回被多个key共用的值及对应的keys
+// 需要在内存中保存所有扫描到的值，keys较多时应缩小match范围
+func (p *Redis) FindDuplicateValues(db int, match string) (map[string][]string, error) {
+	conn, err := p.getConn(db)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	byValue := make(map[string][]string)
+	seen := make(map[string]struct{})
+	err = scanKeysOfType(conn, match, "string", func(batch []string) error {
+		// SCAN可能重复返回同一个key，重复的key不应被当作重复的值
+		keys := make([]string, 0, len(batch))
+		for _, key := range batch {
+			if _, ok := seen[key]; !ok {
+				seen[key] = struct{}{}
+				keys = append(keys, key)
+			}
+		}
+		for _, key := range keys {
+			conn.Send("GET", key)
+		}
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+		var firstErr error
+		for _, key := range keys {
+			value, err := redis.String(conn.Receive())
+			if err == redis.ErrNil {
+				continue
+			}
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			byValue[value] = append(byValue[value], key)
+		}
+		return firstErr
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	duplicates := make(map[string][]string)
+	for value, keys := range byValue {
+		if len(keys) > 1 {
+			duplicates[value] = keys
+		}
+	}
+	return duplicates, nil
+}
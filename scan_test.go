@@ -0,0 +1,96 @@
+package redis
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRenameTarget(t *testing.T) {
+	tests := []struct {
+		key, oldPrefix, newPrefix, want string
+	}{
+		{"user:1", "user:", "member:", "member:1"},
+		{"user:", "user:", "member:", "member:"},
+		{"abbc", "ab", "a", "abc"},
+		{"a1", "a", "ab", "ab1"},
+		{"a:\xff", "a:", "b:", "b:\xff"},
+	}
+	for _, tt := range tests {
+		if got := renameTarget(tt.key, tt.oldPrefix, tt.newPrefix); got != tt.want {
+			t.Errorf("renameTarget(%q, %q, %q) = %q, want %q", tt.key, tt.oldPrefix, tt.newPrefix, got, tt.want)
+		}
+	}
+}
+
+func TestRenameRematches(t *testing.T) {
+	tests := []struct {
+		oldPrefix, newPrefix string
+		want                 bool
+	}{
+		{"user:", "member:", false},
+		{"a", "ab", true},
+		{"ab", "a", true},
+		{"ab", "", true},
+		{"ab", "ba", false},
+	}
+	for _, tt := range tests {
+		if got := renameRematches(tt.oldPrefix, tt.newPrefix); got != tt.want {
+			t.Errorf("renameRematches(%q, %q) = %v, want %v", tt.oldPrefix, tt.newPrefix, got, tt.want)
+		}
+	}
+}
+
+// 在内存中按renameOrder的顺序模拟RENAMENX，检查重命名不会串联或丢失
+func TestRenameOrder(t *testing.T) {
+	tests := []struct {
+		name                 string
+		oldPrefix, newPrefix string
+		scanned              []string // SCAN返回的keys，可能重复
+		before, want         map[string]string
+	}{
+		{
+			name:      "shorter prefix",
+			oldPrefix: "ab", newPrefix: "a",
+			scanned: []string{"abbc", "abc", "abc"},
+			before:  map[string]string{"abbc": "1", "abc": "2"},
+			want:    map[string]string{"abc": "1", "ac": "2"},
+		},
+		{
+			name:      "longer prefix",
+			oldPrefix: "a", newPrefix: "ab",
+			scanned: []string{"a1", "ab1"},
+			before:  map[string]string{"a1": "1", "ab1": "2"},
+			want:    map[string]string{"ab1": "1", "abb1": "2"},
+		},
+		{
+			name:      "chain",
+			oldPrefix: "x", newPrefix: "",
+			scanned: []string{"xxa", "xa"},
+			before:  map[string]string{"xxa": "1", "xa": "2"},
+			want:    map[string]string{"xa": "1", "a": "2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := make(map[string]string)
+			for k, v := range tt.before {
+				db[k] = v
+			}
+			for _, key := range renameOrder(tt.scanned, tt.oldPrefix, tt.newPrefix) {
+				value, ok := db[key]
+				if !ok {
+					continue
+				}
+				target := renameTarget(key, tt.oldPrefix, tt.newPrefix)
+				if _, exist := db[target]; exist {
+					continue
+				}
+				delete(db, key)
+				db[target] = value
+			}
+			if !reflect.DeepEqual(db, tt.want) {
+				t.Errorf("after rename = %v, want %v", db, tt.want)
+			}
+		})
+	}
+}
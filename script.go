@@ -0,0 +1,469 @@
+package redis
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 在指定db执行Lua脚本
+func (p *Redis) doScript(db int, script *redis.Script, keysAndArgs ...interface{}) (interface{}, error) {
+	conn, err := p.getConn(db)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return script.Do(conn, keysAndArgs...)
+}
+
+// 按分值加权随机选取成员，随机数由客户端传入，保证脚本是确定性的
+var weightedRandomScript = redis.NewScript(1, `
+local items = redis.call('ZRANGE', KEYS[1], 0, -1, 'WITHSCORES')
+local total = 0
+for i = 2, #items, 2 do
+	local score = tonumber(items[i])
+	if score > 0 then total = total + score end
+end
+if total <= 0 then return false end
+local target = tonumber(ARGV[1]) * total
+local last = false
+for i = 1, #items, 2 do
+	local score = tonumber(items[i + 1])
+	if score > 0 then
+		last = items[i]
+		target = target - score
+		if target < 0 then return items[i] end
+	end
+end
+return last
+`)
+
+// 按有序集合中的分值加权随机选取一个成员，分值<=0的成员不会被选中
+// 集合为空或没有正分值成员时返回redis.ErrNil
+func (p *Redis) WeightedRandom(db int, zkey string) (member string, err error) {
+	return redis.String(p.doScript(db, weightedRandomScript, zkey, rand.Float64()))
+}
+
+// key存在时重置过期时间并返回原来的PTTL，不存在返回-2
+var refreshIfAliveScript = redis.NewScript(1, `
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl == -2 then return -2 end
+redis.call('PEXPIRE', KEYS[1], ARGV[1])
+return ttl
+`)
+
+// key仍存在时将过期时间重置为ttl，返回原剩余时间(原来未设置过期为-1)；key不存在时refreshed为false
+func (p *Redis) RefreshIfAlive(db int, key string, ttl time.Duration) (prevTTL time.Duration, refreshed bool, err error) {
+	ms, err := redis.Int64(p.doScript(db, refreshIfAliveScript, key, toMillis(ttl)))
+	if err != nil {
+		return 0, false, err
+	}
+	if ms == -2 {
+		return 0, false, nil
+	}
+	if ms < 0 {
+		return time.Duration(ms), true, nil
+	}
+	return time.Duration(ms) * time.Millisecond, true, nil
+}
+
+// unpack的参数数量受Lua栈大小限制(约8000)，按每批1000个key执行DEL，仍在同一个脚本中原子完成
+var resetCountersScript = redis.NewScript(-1, `
+local deleted = 0
+for i = 1, #KEYS, 1000 do
+	deleted = deleted + redis.call('DEL', unpack(KEYS, i, math.min(i + 999, #KEYS)))
+end
+return deleted
+`)
+
+// 原子地删除一批计数器，要么全部重置要么都不变
+func (p *Redis) ResetCounters(db int, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if p.DryRun {
+		for _, key := range keys {
+			p.logf("redis dry-run: DEL db=%d key=%s", db, key)
+		}
+		return nil
+	}
+	_, err := p.doScript(db, resetCountersScript, redis.Args{}.Add(len(keys)).AddFlat(keys)...)
+	return err
+}
+
+// 设置成员分值并返回原分值，原来不存在返回nil
+var zaddGetPrevScript = redis.NewScript(1, `
+local prev = redis.call('ZSCORE', KEYS[1], ARGV[2])
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+return prev
+`)
+
+// 设置成员分值，返回设置前的分值及成员原来是否存在
+func (p *Redis) ZAddGetPrev(db int, key, member string, score float64) (prev float64, existed bool, err error) {
+	s, err := redis.String(p.doScript(db, zaddGetPrevScript, key, formatScore(score), member))
+	if err == redis.ErrNil {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	prev, err = strconv.ParseFloat(s, 64)
+	return prev, err == nil, err
+}
+
+var drainListScript = redis.NewScript(1, `
+local items = redis.call('LRANGE', KEYS[1], 0, -1)
+redis.call('DEL', KEYS[1])
+return items
+`)
+
+// 原子地取出列表全部元素并删除列表，key不存在返回空切片；DryRun时只读取不删除
+func (p *Redis) DrainList(db int, key string) ([]string, error) {
+	if p.DryRun {
+		p.logf("redis dry-run: DEL db=%d key=%s", db, key)
+		return redis.Strings(p.Do(db, "LRANGE", key, 0, -1))
+	}
+	return redis.Strings(p.doScript(db, drainListScript, key))
+}
+
+// 增加计数但不超过上限，超过时设为上限；返回 {新值, 是否触顶}
+var incrByCappedScript = redis.NewScript(1, `
+local cur = tonumber(redis.call('GET', KEYS[1]) or '0')
+if cur == nil then return redis.error_reply('ERR value is not an integer') end
+if cur + tonumber(ARGV[1]) > tonumber(ARGV[2]) then
+	redis.call('SET', KEYS[1], ARGV[2], 'KEEPTTL')
+	return {tonumber(ARGV[2]), 1}
+end
+return {redis.call('INCRBY', KEYS[1], ARGV[1]), 0}
+`)
+
+// 原子地增加计数，结果不会超过max；会超过时值设为max并返回capped为true
+func (p *Redis) IncrByCapped(db int, key string, delta, max int64) (newVal int64, capped bool, err error) {
+	return boundedResult(p.doScript(db, incrByCappedScript, key, delta, max))
+}
+
+func boundedResult(reply interface{}, err error) (int64, bool, error) {
+	values, err := redis.Int64s(reply, err)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(values) != 2 {
+		return 0, false, fmt.Errorf("脚本返回格式错误: %v", values)
+	}
+	return values[0], values[1] == 1, nil
+}
+
+// 减少计数但不低于下限，低于时设为下限；返回 {新值, 是否触底}
+var decrByFlooredScript = redis.NewScript(1, `
+local cur = tonumber(redis.call('GET', KEYS[1]) or '0')
+if cur == nil then return redis.error_reply('ERR value is not an integer') end
+if cur - tonumber(ARGV[1]) < tonumber(ARGV[2]) then
+	redis.call('SET', KEYS[1], ARGV[2], 'KEEPTTL')
+	return {tonumber(ARGV[2]), 1}
+end
+return {redis.call('DECRBY', KEYS[1], ARGV[1]), 0}
+`)
+
+// 原子地减少计数，结果不会低于min；会低于时值设为min并返回floored为true
+func (p *Redis) DecrByFloored(db int, key string, delta, min int64) (newVal int64, floored bool, err error) {
+	return boundedResult(p.doScript(db, decrByFlooredScript, key, delta, min))
+}
+
+// 以下脚本使用服务器时间(毫秒)作为分值，避免客户端时钟偏差
+// replicate_commands保证在TIME之后可以执行写命令（Redis 7以下需要）
+var zaddNowScript = redis.NewScript(1, `
+redis.replicate_commands()
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+return redis.call('ZADD', KEYS[1], now, ARGV[1])
+`)
+
+var ztrimOlderThanScript = redis.NewScript(1, `
+redis.replicate_commands()
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+return redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. (now - tonumber(ARGV[1])))
+`)
+
+var zcountInWindowScript = redis.NewScript(1, `
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+return redis.call('ZCOUNT', KEYS[1], now - tonumber(ARGV[1]), '+inf')
+`)
+
+// 添加成员，分值为当前服务器时间(毫秒)
+func (p *Redis) ZAddNow(db int, key, member string) error {
+	_, err := p.doScript(db, zaddNowScript, key, member)
+	return err
+}
+
+// 删除分值早于 服务器当前时间-age 的成员，返回删除的数量
+func (p *Redis) ZTrimOlderThan(db int, key string, age time.Duration) (int64, error) {
+	return redis.Int64(p.doScript(db, ztrimOlderThanScript, key, toMillis(age)))
+}
+
+// 统计最近window时间内(按服务器时间)添加的成员数
+func (p *Redis) ZCountInWindow(db int, key string, window time.Duration) (int64, error) {
+	return redis.Int64(p.doScript(db, zcountInWindowScript, key, toMillis(window)))
+}
+
+// 列表中不存在该值时才LPUSH（LPOS，Redis 6.0.6+），返回是否写入
+var lpushUniqueScript = redis.NewScript(1, `
+if redis.call('LPOS', KEYS[1], ARGV[1]) then return 0 end
+redis.call('LPUSH', KEYS[1], ARGV[1])
+return 1
+`)
+
+// 原子地检查并写入列表头部，值已存在时不写入；值的编码方式与LPUSH相同
+func (p *Redis) LPushUnique(db int, key string, value interface{}) (pushed bool, err error) {
+	v, err := encodeValue(value)
+	if err != nil {
+		return false, err
+	}
+	return redis.Bool(p.doScript(db, lpushUniqueScript, key, v))
+}
+
+// 时间衰减分值：存储的分值 = 分数 * 2^((加入时间-基准时间)/半衰期)，读取时再乘以 2^((基准时间-当前时间)/半衰期)
+// 基准时间保存在 key:epoch 中；指数超过64时将全部分值按当前时间重新定基，避免浮点溢出
+var zaddDecayingScript = redis.NewScript(2, `
+redis.replicate_commands()
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+local halfLife = tonumber(ARGV[3])
+local epoch = tonumber(redis.call('GET', KEYS[2]))
+if not epoch then
+	epoch = now
+	redis.call('SET', KEYS[2], string.format('%.6f', now))
+end
+local exp = (now - epoch) / halfLife
+if exp > 64 then
+	local scale = 2 ^ (-exp)
+	local items = redis.call('ZRANGE', KEYS[1], 0, -1, 'WITHSCORES')
+	for i = 1, #items, 2 do
+		redis.call('ZADD', KEYS[1], tonumber(items[i + 1]) * scale, items[i])
+	end
+	redis.call('SET', KEYS[2], string.format('%.6f', now))
+	exp = 0
+end
+return redis.call('ZINCRBY', KEYS[1], tonumber(ARGV[2]) * 2 ^ exp, ARGV[1])
+`)
+
+// 按分值从高到低取前ARGV[1]个成员，返回 member, 衰减后分值 交替列表
+var zrangeDecayingScript = redis.NewScript(2, `
+local epoch = tonumber(redis.call('GET', KEYS[2]))
+if not epoch then return {} end
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+local factor = 2 ^ ((epoch - now) / tonumber(ARGV[2]))
+local items = redis.call('ZREVRANGE', KEYS[1], 0, tonumber(ARGV[1]) - 1, 'WITHSCORES')
+for i = 2, #items, 2 do
+	items[i] = string.format('%.17g', tonumber(items[i]) * factor)
+end
+return items
+`)
+
+func decayEpochKey(key string) string {
+	return key + ":epoch"
+}
+
+// 为成员加分，分数随时间按半衰期halfLife指数衰减（使用服务器时间），用于热度排行
+// 同一个key必须始终使用相同的halfLife
+func (p *Redis) ZAddDecaying(db int, key, member string, points float64, halfLife time.Duration) error {
+	if halfLife <= 0 {
+		return fmt.Errorf("halfLife 必须大于0")
+	}
+	_, err := p.doScript(db, zaddDecayingScript, key, decayEpochKey(key), member, scoreString(points), scoreString(halfLife.Seconds()))
+	return err
+}
+
+// 获取当前衰减后分值最高的前n个成员
+func (p *Redis) ZRangeDecaying(db int, key string, n int, halfLife time.Duration) ([]ZMember, error) {
+	if halfLife <= 0 || n <= 0 {
+		return nil, fmt.Errorf("halfLife 和 n 必须大于0")
+	}
+	pairs, err := redis.Strings(p.doScript(db, zrangeDecayingScript, key, decayEpochKey(key), n, scoreString(halfLife.Seconds())))
+	if err != nil {
+		return nil, err
+	}
+	return parseZMembers(pairs)
+}
+
+// 按点分隔的路径在JSON文档中定位，数组下标从0开始；返回父节点和最后一段对应的Lua下标
+// 路径中间节点不存在时create为true则创建空对象，否则返回nil
+// jsonExact检查数值能否被cjson原样编码：cjson默认只保留14位有效数字，超过的数值(如大整数ID、高精度时间戳)会被改写
+var jsonPathLua = `
+local function jsonExact(v)
+	if type(v) == 'number' then
+		return tonumber(string.format('%.14g', v)) == v
+	end
+	if type(v) == 'table' then
+		for _, x in pairs(v) do
+			if not jsonExact(x) then return false end
+		end
+	end
+	return true
+end
+local function jsonLocate(doc, path, create)
+	local parts = {}
+	for part in string.gmatch(path, '[^.]+') do parts[#parts + 1] = part end
+	local node = doc
+	for i = 1, #parts do
+		if type(node) ~= 'table' then return nil end
+		local k = parts[i]
+		local idx = tonumber(k)
+		if idx and #node > 0 then k = idx + 1 end
+		if i == #parts then return node, k end
+		if node[k] == nil then
+			if not create then return nil end
+			node[k] = {}
+		end
+		node = node[k]
+	end
+end
+`
+
+var jsonSetScript = redis.NewScript(1, jsonPathLua+`
+local raw = redis.call('GET', KEYS[1])
+local value = cjson.decode(ARGV[2])
+local doc
+if ARGV[1] == '' then
+	doc = value
+else
+	doc = {}
+	if raw then doc = cjson.decode(raw) end
+	local parent, k = jsonLocate(doc, ARGV[1], true)
+	if not parent then return redis.error_reply('ERR json path is not an object') end
+	parent[k] = value
+end
+if not jsonExact(doc) then
+	return redis.error_reply('ERR json number has more than 14 significant digits and would lose precision')
+end
+if raw then
+	return redis.call('SET', KEYS[1], cjson.encode(doc), 'KEEPTTL')
+end
+return redis.call('SET', KEYS[1], cjson.encode(doc))
+`)
+
+var jsonGetScript = redis.NewScript(1, jsonPathLua+`
+local raw = redis.call('GET', KEYS[1])
+if not raw then return false end
+if ARGV[1] == '' then return raw end
+local parent, k = jsonLocate(cjson.decode(raw), ARGV[1], false)
+if not parent or parent[k] == nil then return false end
+if not jsonExact(parent[k]) then
+	return redis.error_reply('ERR json number has more than 14 significant digits and would lose precision')
+end
+return cjson.encode(parent[k])
+`)
+
+// 原子地修改以字符串保存的JSON文档中path(点分隔，如"profile.name"，空为整个文档)处的值，保留原过期时间
+// 基于Lua cjson实现，适合较小的文档；空对象和空数组无法区分，编码后均为{}
+// cjson只保留14位有效数字，文档中有超过14位的数值(如int64 ID)时返回错误且不修改，这类数值应保存为字符串
+func (p *Redis) JSONSet(db int, key, path string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = p.doScript(db, jsonSetScript, key, path, data)
+	return err
+}
+
+// 读取JSON文档中path处的值，key或路径不存在返回redis.ErrNil
+// path不为空且该值中有超过14位有效数字的数值时返回错误，path为空时原样返回整个文档
+func (p *Redis) JSONGet(db int, key, path string) (json.RawMessage, error) {
+	data, err := redis.Bytes(p.doScript(db, jsonGetScript, key, path))
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(data), nil
+}
+
+// 先检查所有字段都是整数且加上增量后不溢出，再逐个HINCRBY
+// Lua数值为double，溢出检查在int64边界附近不精确，此时HINCRBY仍可能报错，出错后将已修改的字段恢复为原值
+var hincrByMultiScript = redis.NewScript(1, `
+local old = {}
+for i = 1, #ARGV, 2 do
+	local v = redis.call('HGET', KEYS[1], ARGV[i])
+	if v and not string.match(v, '^-?%d+$') then
+		return redis.error_reply('ERR hash value is not an integer: ' .. ARGV[i])
+	end
+	local sum = tonumber(v or '0') + tonumber(ARGV[i + 1])
+	if sum >= 2^63 or sum < -2^63 then
+		return redis.error_reply('ERR increment or decrement would overflow: ' .. ARGV[i])
+	end
+	old[i] = v
+end
+local result = {}
+for i = 1, #ARGV, 2 do
+	local r = redis.pcall('HINCRBY', KEYS[1], ARGV[i], ARGV[i + 1])
+	if type(r) == 'table' and r.err then
+		for j = 1, i - 2, 2 do
+			if old[j] then
+				redis.call('HSET', KEYS[1], ARGV[j], old[j])
+			else
+				redis.call('HDEL', KEYS[1], ARGV[j])
+			end
+		end
+		return r
+	end
+	result[#result + 1] = r
+end
+return result
+`)
+
+// 原子地对hash的多个字段执行HINCRBY，返回各字段的新值；任一字段不是整数或会溢出时不修改任何字段
+func (p *Redis) HIncrByMulti(db int, key string, deltas map[string]int64) (map[string]int64, error) {
+	result := make(map[string]int64, len(deltas))
+	if len(deltas) == 0 {
+		return result, nil
+	}
+	fields := make([]string, 0, len(deltas))
+	args := redis.Args{}.Add(key)
+	for field, delta := range deltas {
+		fields = append(fields, field)
+		args = args.Add(field, delta)
+	}
+	values, err := redis.Int64s(p.doScript(db, hincrByMultiScript, args...))
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != len(fields) {
+		return nil, fmt.Errorf("HIncrByMulti 返回数量错误: %d != %d", len(values), len(fields))
+	}
+	for i, field := range fields {
+		result[field] = values[i]
+	}
+	return result, nil
+}
+
+var swapKeysScript = redis.NewScript(3, `
+local e1 = redis.call('EXISTS', KEYS[1]) == 1
+local e2 = redis.call('EXISTS', KEYS[2]) == 1
+if e1 and e2 then
+	if redis.call('EXISTS', KEYS[3]) == 1 then
+		return redis.error_reply('ERR swap temp key already exists: ' .. KEYS[3])
+	end
+	redis.call('RENAME', KEYS[1], KEYS[3])
+	redis.call('RENAME', KEYS[2], KEYS[1])
+	redis.call('RENAME', KEYS[3], KEYS[2])
+elseif e1 then
+	redis.call('RENAME', KEYS[1], KEYS[2])
+elseif e2 then
+	redis.call('RENAME', KEYS[2], KEYS[1])
+end
+return 1
+`)
+
+// 原子地交换两个key的值，过期时间随值一起交换；其中一个不存在时相当于重命名另一个
+// 交换时经过临时key key1+":swap.tmp"，集群模式下需用hash tag保证两个key在同一槽位
+func (p *Redis) SwapKeys(db int, key1, key2 string) error {
+	if key1 == key2 {
+		return nil
+	}
+	_, err := p.doScript(db, swapKeysScript, key1, key2, key1+":swap.tmp")
+	return err
+}
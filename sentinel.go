@@ -0,0 +1,90 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 连接Sentinel及查询主节点的超时时间
+const sentinelTimeout = 500 * time.Millisecond
+
+// 依次询问配置的Sentinel，返回MasterName当前主节点的地址(host:port)
+func resolveMaster(cfg Config) (string, error) {
+	var lastErr error
+	for _, sentinel := range cfg.SentinelAddrs {
+		c, err := redis.Dial("tcp", sentinel,
+			redis.DialConnectTimeout(sentinelTimeout),
+			redis.DialReadTimeout(sentinelTimeout),
+			redis.DialWriteTimeout(sentinelTimeout))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		addr, err := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", cfg.MasterName))
+		c.Close()
+		if err == redis.ErrNil {
+			lastErr = fmt.Errorf("sentinel %s 中没有主节点 %s", sentinel, cfg.MasterName)
+			continue
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(addr) != 2 {
+			lastErr = fmt.Errorf("sentinel %s 返回格式错误: %v", sentinel, addr)
+			continue
+		}
+		return net.JoinHostPort(addr[0], addr[1]), nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("没有可用的sentinel")
+	}
+	return "", fmt.Errorf("查询主节点 %s 失败: %v", cfg.MasterName, lastErr)
+}
+
+// 新建连接的地址：配置了Sentinel时每次重新查询主节点，否则为Host:Port
+func dialAddr(cfg Config) (string, error) {
+	if len(cfg.SentinelAddrs) > 0 {
+		return resolveMaster(cfg)
+	}
+	return fmt.Sprintf("%v:%v", cfg.Host, cfg.Port), nil
+}
+
+// 是否为连接层面的错误(连接断开、超时、无法建立连接等)，服务端返回的错误不算
+func isConnError(err error) bool {
+	if err == nil || err == redis.ErrPoolExhausted || errors.Is(err, ErrAuthFailed) {
+		return false
+	}
+	_, ok := err.(redis.Error)
+	return !ok
+}
+
+// 通过Sentinel连接的主节点连接，记录建立连接时的主节点地址
+type masterConn struct {
+	redis.Conn
+	addr string
+}
+
+func (p *Redis) currentMaster() string {
+	addr, _ := p.masterAddr.Load().(string)
+	return addr
+}
+
+// 主从切换后的重试：重新查询主节点并记录新地址，连接旧主节点的空闲连接在取出时被丢弃，然后重试一次
+func (p *Redis) doFailover(db int, command string, args []interface{}, cause error) (interface{}, error) {
+	addr, err := resolveMaster(p.config)
+	if err != nil {
+		p.logf("redis: %s 连接错误: %v，%v", command, cause, err)
+		return nil, cause
+	}
+	if addr != p.currentMaster() {
+		p.logf("redis: 主节点切换到%s", addr)
+		p.masterAddr.Store(addr)
+	}
+	p.logf("redis: %s 连接错误，重试: %v", command, cause)
+	return p.doRoute(db, command, args...)
+}
@@ -0,0 +1,133 @@
+package redis
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Count-Min Sketch 参数：cmsDepth行，每行cmsWidth个u32计数器，共占用约40KB
+// 估计值误差约为 总计数*e/cmsWidth，误差超出的概率约为 e^-cmsDepth
+const (
+	cmsDepth = 5
+	cmsWidth = 2000
+)
+
+// 计算item在各行对应的计数器下标
+func cmsIndexes(item string) []uint64 {
+	h1, h2 := hashPair(item)
+	indexes := make([]uint64, cmsDepth)
+	for row := uint64(0); row < cmsDepth; row++ {
+		indexes[row] = row*cmsWidth + (h1+row*h2)%cmsWidth
+	}
+	return indexes
+}
+
+// 由FNV-64a得到两个32位哈希值，用于双重哈希
+func hashPair(item string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(item))
+	sum := h.Sum64()
+	return sum & 0xffffffff, sum>>32 | 1
+}
+
+// Count-Min Sketch计数，计数器达到上限或减到0后不再变化
+func (p *Redis) CMSIncr(db int, key string, item string, count int64) error {
+	args := redis.Args{}.Add(key, "OVERFLOW", "SAT")
+	for _, index := range cmsIndexes(item) {
+		args = args.Add("INCRBY", "u32", "#"+strconv.FormatUint(index, 10), count)
+	}
+	_, err := p.Do(db, "BITFIELD", args...)
+	return err
+}
+
+// Count-Min Sketch估计item的计数，取各行计数器的最小值，只会高估不会低估
+func (p *Redis) CMSEstimate(db int, key, item string) (int64, error) {
+	args := redis.Args{}.Add(key)
+	for _, index := range cmsIndexes(item) {
+		args = args.Add("GET", "u32", "#"+strconv.FormatUint(index, 10))
+	}
+	counters, err := redis.Int64s(p.Do(db, "BITFIELD", args...))
+	if err != nil {
+		return 0, err
+	}
+	var min int64 = -1
+	for _, c := range counters {
+		if min < 0 || c < min {
+			min = c
+		}
+	}
+	if min < 0 {
+		return 0, nil
+	}
+	return min, nil
+}
+
+// Bloom过滤器的参数保存在该hash中，字段m为位数，k为哈希函数个数
+func bloomMetaKey(key string) string {
+	return key + ":meta"
+}
+
+var bloomAddScript = redis.NewScript(2, `
+local m = tonumber(redis.call('HGET', KEYS[2], 'm'))
+local k = tonumber(redis.call('HGET', KEYS[2], 'k'))
+if not m or not k then return redis.error_reply('ERR bloom filter not initialized') end
+local h1, h2 = tonumber(ARGV[1]), tonumber(ARGV[2])
+for i = 0, k - 1 do
+	redis.call('SETBIT', KEYS[1], (h1 + i * h2) % m, 1)
+end
+return 1
+`)
+
+var bloomExistsScript = redis.NewScript(2, `
+local m = tonumber(redis.call('HGET', KEYS[2], 'm'))
+local k = tonumber(redis.call('HGET', KEYS[2], 'k'))
+if not m or not k then return redis.error_reply('ERR bloom filter not initialized') end
+local h1, h2 = tonumber(ARGV[1]), tonumber(ARGV[2])
+for i = 0, k - 1 do
+	if redis.call('GETBIT', KEYS[1], (h1 + i * h2) % m) == 0 then return 0 end
+end
+return 1
+`)
+
+// 按预计元素数和误判率创建Bloom过滤器，已存在时保持原有参数不变
+func (p *Redis) NewBloom(db int, key string, expectedItems int, falsePositiveRate float64) error {
+	if expectedItems <= 0 || falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		return fmt.Errorf("expectedItems 必须大于0，falsePositiveRate 必须在(0, 1)之间")
+	}
+	n := float64(expectedItems)
+	m := math.Ceil(-n * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	if m > 1<<32 {
+		return fmt.Errorf("bloom过滤器过大: %v 位", m)
+	}
+	k := math.Max(1, math.Round(m/n*math.Ln2))
+
+	conn, err := p.getConn(db)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	metaKey := bloomMetaKey(key)
+	conn.Send("MULTI")
+	conn.Send("HSETNX", metaKey, "m", int64(m))
+	conn.Send("HSETNX", metaKey, "k", int64(k))
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// 加入Bloom过滤器，需先调用NewBloom
+func (p *Redis) BloomAdd(db int, key, item string) error {
+	h1, h2 := hashPair(item)
+	_, err := p.doScript(db, bloomAddScript, key, bloomMetaKey(key), h1, h2)
+	return err
+}
+
+// 判断是否可能在Bloom过滤器中：false表示一定不在，true表示可能在
+func (p *Redis) BloomExists(db int, key, item string) (bool, error) {
+	h1, h2 := hashPair(item)
+	return redis.Bool(p.doScript(db, bloomExistsScript, key, bloomMetaKey(key), h1, h2))
+}
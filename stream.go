@@ -0,0 +1,309 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Stream中的一条消息
+type StreamMessage struct {
+	ID     string
+	Values map[string]string
+}
+
+// 解析XRANGE/XREVRANGE等返回的消息列表，已被删除的消息(字段为nil)会被跳过
+func parseStreamMessages(reply interface{}, err error) ([]StreamMessage, error) {
+	entries, err := redis.Values(reply, err)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]StreamMessage, 0, len(entries))
+	for _, entry := range entries {
+		parts, err := redis.Values(entry, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("stream 消息格式错误: %v", parts)
+		}
+		id, err := redis.String(parts[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		if parts[1] == nil {
+			continue
+		}
+		values, err := redis.StringMap(parts[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, StreamMessage{ID: id, Values: values})
+	}
+	return messages, nil
+}
+
+// 比较两个stream消息ID，a<b返回负数，相等返回0，a>b返回正数
+func compareStreamID(a, b string) int {
+	ams, aseq := splitStreamID(a)
+	bms, bseq := splitStreamID(b)
+	switch {
+	case ams != bms:
+		if ams < bms {
+			return -1
+		}
+		return 1
+	case aseq != bseq:
+		if aseq < bseq {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+func splitStreamID(id string) (uint64, uint64) {
+	ms, seq := id, "0"
+	if i := strings.IndexByte(id, '-'); i >= 0 {
+		ms, seq = id[:i], id[i+1:]
+	}
+	a, _ := strconv.ParseUint(ms, 10, 64)
+	b, _ := strconv.ParseUint(seq, 10, 64)
+	return a, b
+}
+
+// 每次XRANGE分页读取的数量
+const streamPageSize = 1000
+
+// 解析XINFO返回的 field, value 交替列表
+func parseInfoFields(reply interface{}, err error) (map[string]interface{}, error) {
+	values, err := redis.Values(reply, err)
+	if err != nil {
+		return nil, err
+	}
+	if len(values)%2 != 0 {
+		return nil, fmt.Errorf("XINFO 返回格式错误: %v", values)
+	}
+	fields := make(map[string]interface{}, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		name, err := redis.String(values[i], nil)
+		if err != nil {
+			return nil, err
+		}
+		fields[name] = values[i+1]
+	}
+	return fields, nil
+}
+
+// 消费组的积压量：stream中在消费组last-delivered-id之后的消息数
+// Redis 7+优先使用XINFO GROUPS的lag字段，不可用时分页XRANGE计数
+func (p *Redis) ConsumerLag(db int, stream, group string) (int64, error) {
+	groups, err := p.XInfoGroups(db, stream)
+	if err != nil {
+		return 0, err
+	}
+	for _, g := range groups {
+		if g.Name != group {
+			continue
+		}
+		if g.LagKnown {
+			return g.Lag, nil
+		}
+		return p.countStreamAfter(db, stream, g.LastDeliveredID)
+	}
+	return 0, fmt.Errorf("消费组 %s 不存在", group)
+}
+
+// 统计ID大于after的消息数
+func (p *Redis) countStreamAfter(db int, stream, after string) (int64, error) {
+	var count int64
+	for {
+		messages, err := parseStreamMessages(p.Do(db, "XRANGE", stream, "("+after, "+", "COUNT", streamPageSize))
+		if err != nil {
+			return 0, err
+		}
+		count += int64(len(messages))
+		if len(messages) < streamPageSize {
+			return count, nil
+		}
+		after = messages[len(messages)-1].ID
+	}
+}
+
+// XConsume每次读取的消息数和阻塞等待时间
+const (
+	consumeCount = 10
+	consumeBlock = time.Second
+)
+
+// 以消费组方式消费stream，handler返回nil时才XACK；返回错误的消息保留在待处理列表中，可由XAutoClaim认领重试
+// 阻塞直到ctx取消（返回nil）或出错
+func (p *Redis) XConsume(ctx context.Context, db int, stream, group, consumer string, handler func(msg StreamMessage) error) error {
+	for ctx.Err() == nil {
+		reply, err := p.Do(db, "XREADGROUP", "GROUP", group, consumer,
+			"COUNT", consumeCount, "BLOCK", int64(consumeBlock/time.Millisecond), "STREAMS", stream, ">")
+		if err != nil {
+			return err
+		}
+		if reply == nil {
+			continue // 超时没有新消息
+		}
+		messages, err := parseXReadStream(reply)
+		if err != nil {
+			return err
+		}
+		for _, msg := range messages {
+			if err := handler(msg); err != nil {
+				p.logf("redis: stream %s 消息 %s 处理失败，保留待重试: %v", stream, msg.ID, err)
+				continue
+			}
+			if _, err := p.Do(db, "XACK", stream, group, msg.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 解析单个stream的XREAD/XREADGROUP返回：[[stream, [[id, fields], ...]]]
+func parseXReadStream(reply interface{}) ([]StreamMessage, error) {
+	streams, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	var messages []StreamMessage
+	for _, st := range streams {
+		parts, err := redis.Values(st, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("XREAD 返回格式错误: %v", parts)
+		}
+		msgs, err := parseStreamMessages(parts[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msgs...)
+	}
+	return messages, nil
+}
+
+// XAUTOCLAIM(Redis 6.2+)：从start开始把空闲超过minIdle的待确认消息转给consumer，最多count条
+// 返回下一次调用的游标，为"0-0"表示已遍历完；已被删除的消息不包含在claimed中
+func (p *Redis) XAutoClaim(db int, stream, group, consumer string, minIdle time.Duration, start string, count int) (nextCursor string, claimed []StreamMessage, err error) {
+	args := redis.Args{}.Add(stream, group, consumer, toMillis(minIdle), start)
+	if count > 0 {
+		args = args.Add("COUNT", count)
+	}
+	reply, err := redis.Values(p.Do(db, "XAUTOCLAIM", args...))
+	if err != nil {
+		return "", nil, err
+	}
+	// Redis 7起有第三个元素，为已被删除的消息ID
+	if len(reply) < 2 {
+		return "", nil, fmt.Errorf("XAUTOCLAIM 返回格式错误: %v", reply)
+	}
+	if nextCursor, err = redis.String(reply[0], nil); err != nil {
+		return "", nil, err
+	}
+	claimed, err = parseStreamMessages(reply[1], nil)
+	return nextCursor, claimed, err
+}
+
+// XINFO STREAM的结果
+type StreamInfo struct {
+	Length          int64
+	Groups          int64
+	LastGeneratedID string
+	EntriesAdded    int64          // 累计写入的消息数(Redis 7+)，旧版本为0
+	FirstEntry      *StreamMessage // stream为空时为nil
+	LastEntry       *StreamMessage
+}
+
+// XINFO GROUPS中的一个消费组
+type GroupInfo struct {
+	Name            string
+	Consumers       int64
+	Pending         int64 // 已投递未确认的消息数
+	LastDeliveredID string
+	EntriesRead     int64 // Redis 7+
+	Lag             int64 // 尚未投递的消息数，LagKnown为false时无效
+	LagKnown        bool  // Redis 7以下或服务端无法计算时为false
+}
+
+// 读取stream的长度、最后生成的ID及首尾消息
+func (p *Redis) XInfoStream(db int, stream string) (StreamInfo, error) {
+	var info StreamInfo
+	fields, err := parseInfoFields(p.Do(db, "XINFO", "STREAM", stream))
+	if err != nil {
+		return info, err
+	}
+	if info.Length, err = redis.Int64(fields["length"], nil); err != nil {
+		return info, err
+	}
+	if info.Groups, err = redis.Int64(fields["groups"], nil); err != nil {
+		return info, err
+	}
+	if info.LastGeneratedID, err = redis.String(fields["last-generated-id"], nil); err != nil {
+		return info, err
+	}
+	info.EntriesAdded, _ = redis.Int64(fields["entries-added"], nil)
+	if info.FirstEntry, err = parseStreamEntry(fields["first-entry"]); err != nil {
+		return info, err
+	}
+	if info.LastEntry, err = parseStreamEntry(fields["last-entry"]); err != nil {
+		return info, err
+	}
+	return info, nil
+}
+
+// 解析XINFO STREAM中的单条消息，nil表示没有消息
+func parseStreamEntry(entry interface{}) (*StreamMessage, error) {
+	if entry == nil {
+		return nil, nil
+	}
+	messages, err := parseStreamMessages([]interface{}{entry}, nil)
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+	return &messages[0], nil
+}
+
+// 读取stream的所有消费组及其待确认数和积压
+func (p *Redis) XInfoGroups(db int, stream string) ([]GroupInfo, error) {
+	groups, err := redis.Values(p.Do(db, "XINFO", "GROUPS", stream))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]GroupInfo, 0, len(groups))
+	for _, g := range groups {
+		fields, err := parseInfoFields(g, nil)
+		if err != nil {
+			return nil, err
+		}
+		var info GroupInfo
+		if info.Name, err = redis.String(fields["name"], nil); err != nil {
+			return nil, err
+		}
+		if info.Consumers, err = redis.Int64(fields["consumers"], nil); err != nil {
+			return nil, err
+		}
+		if info.Pending, err = redis.Int64(fields["pending"], nil); err != nil {
+			return nil, err
+		}
+		if info.LastDeliveredID, err = redis.String(fields["last-delivered-id"], nil); err != nil {
+			return nil, err
+		}
+		info.EntriesRead, _ = redis.Int64(fields["entries-read"], nil)
+		if lag, err := redis.Int64(fields["lag"], nil); err == nil {
+			info.Lag, info.LagKnown = lag, true
+		}
+		result = append(result, info)
+	}
+	return result, nil
+}
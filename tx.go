@@ -0,0 +1,118 @@
+package redis
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// MULTI/EXEC事务，排队的命令在EXEC后按各自类型转换结果
+type Tx struct {
+	cmds []txCommand
+}
+
+type txCommand struct {
+	name   string
+	args   []interface{}
+	decode func(reply interface{}) (interface{}, error)
+}
+
+func rawReply(reply interface{}) (interface{}, error) {
+	return reply, nil
+}
+
+// 排队任意命令，结果不做转换
+func (tx *Tx) Queue(command string, args ...interface{}) {
+	tx.cmds = append(tx.cmds, txCommand{command, args, rawReply})
+}
+
+// 结果为string，key不存在时为空字符串
+func (tx *Tx) QueueGet(key string) {
+	tx.cmds = append(tx.cmds, txCommand{"GET", []interface{}{key}, func(reply interface{}) (interface{}, error) {
+		s, err := redis.String(reply, nil)
+		if err == redis.ErrNil {
+			return "", nil
+		}
+		return s, err
+	}})
+}
+
+// 结果为string("OK")
+func (tx *Tx) QueueSet(key string, value interface{}) {
+	tx.cmds = append(tx.cmds, txCommand{"SET", []interface{}{key, value}, func(reply interface{}) (interface{}, error) {
+		return redis.String(reply, nil)
+	}})
+}
+
+// 结果为int64
+func (tx *Tx) QueueIncr(key string) {
+	tx.QueueIncrBy(key, 1)
+}
+
+// 结果为int64
+func (tx *Tx) QueueIncrBy(key string, delta int64) {
+	tx.cmds = append(tx.cmds, txCommand{"INCRBY", []interface{}{key, delta}, func(reply interface{}) (interface{}, error) {
+		return redis.Int64(reply, nil)
+	}})
+}
+
+// 结果为int64，删除的数量
+func (tx *Tx) QueueDel(keys ...string) {
+	tx.cmds = append(tx.cmds, txCommand{"DEL", redis.Args{}.AddFlat(keys), func(reply interface{}) (interface{}, error) {
+		return redis.Int64(reply, nil)
+	}})
+}
+
+// 结果为bool，key不存在时为false
+func (tx *Tx) QueueExpire(key string, ttl time.Duration) {
+	tx.cmds = append(tx.cmds, txCommand{"PEXPIRE", []interface{}{key, toMillis(ttl)}, func(reply interface{}) (interface{}, error) {
+		return redis.Bool(reply, nil)
+	}})
+}
+
+// 执行事务，返回与排队顺序一致且已转换类型的结果
+// 某条命令执行失败时，其余结果照常返回，并返回第一个失败的错误
+func (p *Redis) TxTyped(db int, fn func(tx *Tx)) ([]interface{}, error) {
+	tx := &Tx{}
+	fn(tx)
+	if len(tx.cmds) == 0 {
+		return nil, nil
+	}
+
+	conn, err := p.getConn(db)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	for _, cmd := range tx.cmds {
+		conn.Send(cmd.name, cmd.args...)
+	}
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+	if len(replies) != len(tx.cmds) {
+		return nil, fmt.Errorf("EXEC 返回数量错误: %d != %d", len(replies), len(tx.cmds))
+	}
+
+	var firstErr error
+	results := make([]interface{}, len(replies))
+	for i, reply := range replies {
+		if e, ok := reply.(redis.Error); ok {
+			results[i] = e
+			if firstErr == nil {
+				firstErr = fmt.Errorf("第%d条命令 %s 执行失败: %v", i+1, tx.cmds[i].name, e)
+			}
+			continue
+		}
+		result, err := tx.cmds[i].decode(reply)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		results[i] = result
+	}
+	return results, firstErr
+}